@@ -0,0 +1,229 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/log"
+)
+
+// Compression is a compression format of tar archives.
+type Compression string
+
+const (
+	Uncompressed Compression = "none"
+	Gzip         Compression = "gzip"
+	Zstd         Compression = "zstd"
+	Xz           Compression = "xz"
+	Lz4          Compression = "lz4"
+)
+
+var suffixes = []struct {
+	suffix      string
+	compression Compression
+}{
+	{".tar", Uncompressed},
+	{".tar.gz", Gzip},
+	{".tgz", Gzip},
+	{".tar.zst", Zstd},
+	{".tar.xz", Xz},
+	{".tar.lz4", Lz4},
+}
+
+var magics = []struct {
+	magic       []byte
+	compression Compression
+}{
+	{[]byte{0x1f, 0x8b}, Gzip},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, Zstd},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, Xz},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, Lz4},
+}
+
+// Formats other than gzip are handled by their command line tools,
+// which are much faster than pure Go implementations and use all CPUs.
+var compressors = map[Compression][]string{
+	Zstd: {"zstd", "-q", "-c", "-T0"},
+	Xz:   {"xz", "-q", "-c", "-T0"},
+	Lz4:  {"lz4", "-q", "-c"},
+}
+
+var decompressors = map[Compression][]string{
+	Zstd: {"zstd", "-q", "-d", "-c"},
+	Xz:   {"xz", "-q", "-d", "-c"},
+	Lz4:  {"lz4", "-q", "-d", "-c"},
+}
+
+// ParseCompression parses the name of a compression format, e.g. the value of --compress.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(strings.ToLower(name)); c {
+	case "", Uncompressed:
+		return Uncompressed, nil
+	case Gzip, Zstd, Xz, Lz4:
+		return c, nil
+	}
+	return Uncompressed, errors.Errorf("Unknown compression %s", name)
+}
+
+// CompressionFromPath detects the compression of a tar archive by the suffix of path.
+// ok is false if path does not look like a tar archive.
+func CompressionFromPath(path string) (c Compression, ok bool) {
+	for _, s := range suffixes {
+		if strings.HasSuffix(path, s.suffix) {
+			return s.compression, true
+		}
+	}
+	return Uncompressed, false
+}
+
+// CheckCompression checks that the command line tool of the compression c is found in PATH,
+// so that a missing one is reported before anything is exported.
+func CheckCompression(c Compression) error {
+	args, ok := compressors[c]
+	if !ok {
+		return nil
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return errors.Errorf("The %s compression requires the %s command, which is not found in PATH", c, args[0])
+	}
+	return nil
+}
+
+// Compress returns a writer which compresses what is written into w.
+// Close must be called to flush the compressed data, it does not close w.
+func Compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Uncompressed:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	}
+	args, ok := compressors[c]
+	if !ok {
+		return nil, errors.Errorf("Unknown compression %s", c)
+	}
+	if err := CheckCompression(c); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = w
+	return startFilter(cmd)
+}
+
+// Decompress returns a reader which decompresses r, detecting the compression by its magic number.
+// An uncompressed r is returned as it is.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(6)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	c := Uncompressed
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			c = m.compression
+			break
+		}
+	}
+	switch c {
+	case Uncompressed:
+		return ioutil.NopCloser(br), nil
+	case Gzip:
+		return gzip.NewReader(br)
+	}
+	if err := CheckCompression(c); err != nil {
+		return nil, err
+	}
+	args := decompressors[c]
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = br
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	log.Debug("decompress", args)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decompress %s archive", c)
+	}
+	return &filterReader{ReadCloser: stdout, cmd: cmd, stderr: stderr}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// filterWriter pipes what is written into a command.
+type filterWriter struct {
+	io.WriteCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func startFilter(cmd *exec.Cmd) (io.WriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	log.Debug("compress", cmd.Args)
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "Failed to run %s", cmd.Args[0])
+	}
+	return &filterWriter{WriteCloser: stdin, cmd: cmd, stderr: stderr}, nil
+}
+
+func (f *filterWriter) Close() error {
+	if err := f.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := f.cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "%s failed: %s", f.cmd.Args[0], strings.TrimSpace(f.stderr.String()))
+	}
+	return nil
+}
+
+// filterReader reads the output of a command.
+type filterReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	done   bool
+	err    error
+}
+
+func (f *filterReader) Read(b []byte) (int, error) {
+	if f.done {
+		return 0, f.err
+	}
+	n, err := f.ReadCloser.Read(b)
+	if err == io.EOF {
+		f.done, f.err = true, io.EOF
+		// Report a failure of the command rather than a truncated archive.
+		if werr := f.cmd.Wait(); werr != nil {
+			f.err = errors.Wrapf(werr, "%s failed: %s", f.cmd.Args[0], strings.TrimSpace(f.stderr.String()))
+		}
+		return n, f.err
+	}
+	return n, err
+}
+
+func (f *filterReader) Close() error {
+	if !f.done {
+		f.done = true
+		f.cmd.Process.Kill()
+		f.cmd.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package archive
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestCompressionFromPath(t *testing.T) {
+	cases := map[string]struct {
+		c  Compression
+		ok bool
+	}{
+		"out.tar":     {Uncompressed, true},
+		"out.tar.gz":  {Gzip, true},
+		"out.tgz":     {Gzip, true},
+		"out.tar.zst": {Zstd, true},
+		"out.tar.xz":  {Xz, true},
+		"out.tar.lz4": {Lz4, true},
+		"out":         {Uncompressed, false},
+		"out.gz":      {Uncompressed, false},
+	}
+	for path, expected := range cases {
+		c, ok := CompressionFromPath(path)
+		if c != expected.c || ok != expected.ok {
+			t.Errorf("CompressionFromPath(%q) should be (%v, %v): got (%v, %v)", path, expected.c, expected.ok, c, ok)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for _, name := range []string{"", "none", "gzip", "ZSTD", "xz", "lz4"} {
+		if _, err := ParseCompression(name); err != nil {
+			t.Errorf("ParseCompression(%q) should not be error: %v", name, err)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestCheckCompression(t *testing.T) {
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	for _, c := range []Compression{Uncompressed, Gzip} {
+		if err := CheckCompression(c); err != nil {
+			t.Errorf("%s: should not be error: %v", c, err)
+		}
+	}
+	for _, c := range []Compression{Zstd, Xz, Lz4} {
+		if err := CheckCompression(c); err == nil {
+			t.Errorf("%s: should be error without its command", c)
+		}
+		if _, err := Compress(ioutil.Discard, c); err == nil {
+			t.Errorf("%s: should be error without its command", c)
+		}
+	}
+}
+
+func TestCompressDecompress(t *testing.T) {
+	data := bytes.Repeat([]byte("droot rootfs archive\n"), 10000)
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd, Xz, Lz4} {
+		if args, ok := compressors[c]; ok {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				t.Logf("skip %s: %v", c, err)
+				continue
+			}
+		}
+		buf := new(bytes.Buffer)
+		w, err := Compress(buf, c)
+		if err != nil {
+			t.Fatalf("%s: should not be error: %v", c, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("%s: should not be error: %v", c, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: should not be error: %v", c, err)
+		}
+		if c != Uncompressed && buf.Len() >= len(data) {
+			t.Errorf("%s: should compress: %d bytes", c, buf.Len())
+		}
+
+		r, err := Decompress(buf)
+		if err != nil {
+			t.Fatalf("%s: should not be error: %v", c, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: should not be error: %v", c, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: should decompress what is compressed", c)
+		}
+	}
+}
+
+func TestDecompressCorrupted(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip(err)
+	}
+	r, err := Decompress(bytes.NewReader([]byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("should be error")
+	}
+}
@@ -0,0 +1,387 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	fp "path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/log"
+)
+
+const (
+	paxXattrPrefix     = "SCHILY.xattr."
+	paxGNUSparsePrefix = "GNU.sparse."
+	blockSize          = 32 * 1024
+)
+
+const maxSymlinks = 255
+
+// extractor extracts a tar archive into a directory.
+type extractor struct {
+	root      string
+	sameOwner bool        // restore the owners of entries, as `tar -xp` does as root
+	resume    bool        // skip entries which have already been extracted
+	dirs      []directory // directories whose mode and times are restored last
+	unsafe    []string    // entries rejected because they escape the root
+}
+
+type directory struct {
+	path   string
+	header *tar.Header
+	fi     os.FileInfo // the directory created, which a later entry may have replaced
+}
+
+// UnsafeEntriesError reports the entries of an archive which were not extracted
+// because they would have been written outside of the destination directory.
+type UnsafeEntriesError struct {
+	Entries []string
+}
+
+func (e *UnsafeEntriesError) Error() string {
+	return fmt.Sprintf("Refused to extract %d entries escaping the destination: %s", len(e.Entries), strings.Join(e.Entries, ", "))
+}
+
+// Extract extracts the tar archive read from r into the directory dir,
+// as faithfully as `tar -xpf` run as root does: owners, modes, times, xattrs
+// (including file capabilities), device nodes, FIFOs and sparse files are restored.
+// Run by another user, device nodes and security.* and trusted.* xattrs which
+// only root may create are skipped with a warning, like tar does.
+//
+// Every entry is confined to dir. Leading slashes are removed from names, and
+// symlinks are resolved as if dir were the root directory, like openat2(2) with
+// RESOLVE_IN_ROOT does. Entries whose names or hard link targets escape dir with
+// ".." are skipped, and reported by an *UnsafeEntriesError once the rest is extracted.
+func Extract(r io.Reader, dir string) error {
+	return extractAll(r, &extractor{root: dir, sameOwner: os.Geteuid() == 0})
+}
+
+// Resume continues an interrupted Extract of the same archive into dir.
+// Entries which have already been extracted are verified and skipped.
+// The times of an entry are restored last, so an entry whose type, size, mode,
+// owner and mtime match its header has been extracted completely.
+func Resume(r io.Reader, dir string) error {
+	return extractAll(r, &extractor{root: dir, sameOwner: os.Geteuid() == 0, resume: true})
+}
+
+func extractAll(r io.Reader, x *extractor) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.extract(h, tr); err != nil {
+			return errors.Wrapf(err, "Failed to extract %s", h.Name)
+		}
+	}
+	// Extracting the contents of a directory changes its times, and a read-only
+	// directory could not be extracted into, so directories are finished last.
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		// A later entry may have replaced the directory, or one of its parents, by a symlink,
+		// which must not be followed out of the destination.
+		if fi, err := os.Lstat(d.path); err != nil || !fi.IsDir() || !os.SameFile(fi, d.fi) {
+			log.Debugf("Skip restoring %s replaced by a later entry", d.header.Name)
+			continue
+		}
+		if err := os.Chmod(d.path, d.header.FileInfo().Mode()); err != nil {
+			return errors.Wrapf(err, "Failed to chmod %s", d.header.Name)
+		}
+		if err := lutimes(d.path, d.header); err != nil {
+			return errors.Wrapf(err, "Failed to set times of %s", d.header.Name)
+		}
+	}
+	if len(x.unsafe) > 0 {
+		return &UnsafeEntriesError{Entries: x.unsafe}
+	}
+	return nil
+}
+
+// clean returns name relative to the root, or false if it escapes the root.
+func clean(name string) (string, bool) {
+	name = path.Clean(fp.ToSlash(name))
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return strings.TrimLeft(name, "/"), true
+}
+
+// resolve returns the path of name in the root. Symlinks in the parent directories
+// are followed as if the root were "/", so that the result never escapes the root.
+// The last component is not followed.
+func (x *extractor) resolve(name string) (string, error) {
+	dir, base := path.Split(name)
+	rest := strings.Split(dir, "/")
+	resolved := []string{}
+	links := 0
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		p := fp.Join(x.root, fp.Join(resolved...), c)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, c)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", errors.Errorf("Too many levels of symbolic links in %s", name)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = resolved[:0]
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return fp.Join(x.root, fp.Join(resolved...), base), nil
+}
+
+func (x *extractor) extract(h *tar.Header, r io.Reader) error {
+	name, ok := clean(h.Name)
+	if !ok {
+		x.reject(h.Name)
+		return nil
+	}
+	if strings.TrimLeft(h.Name, "/") != h.Name {
+		log.Infof("Removing leading '/' from %s", h.Name)
+	}
+	if name == "" {
+		name = "."
+	}
+	if name == "." && h.Typeflag != tar.TypeDir {
+		x.reject(h.Name)
+		return nil
+	}
+	target, err := x.resolve(name)
+	if err != nil {
+		return err
+	}
+	if x.resume && x.extracted(target, h) {
+		log.Debugf("Skip %s extracted already", h.Name)
+		return nil
+	}
+	if err := os.MkdirAll(fp.Dir(target), 0755); err != nil {
+		return err
+	}
+	// Replace an existing file like tar does, but keep existing directories.
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && h.Typeflag == tar.TypeDir) {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	mode := h.FileInfo().Mode()
+	switch h.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		if err := writeFile(target, r, h.Size, isSparse(h)); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkname, ok := clean(h.Linkname)
+		if !ok {
+			x.reject(h.Name + " -> " + h.Linkname)
+			return nil
+		}
+		source, err := x.resolve(linkname)
+		if err != nil {
+			return err
+		}
+		// Hard links share the metadata of their target, which has already been restored.
+		return os.Link(source, target)
+	case tar.TypeSymlink:
+		if err := os.Symlink(h.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := mknod(target, h); err != nil {
+			// Like tar, only warn about device nodes a user other than root can not create.
+			if !x.sameOwner && h.Typeflag != tar.TypeFifo && os.IsPermission(err) {
+				log.Infof("Cannot create %s: %v", h.Name, err)
+				return nil
+			}
+			return err
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		log.Debugf("Skip %s of unsupported type %c", h.Name, h.Typeflag)
+		return nil
+	}
+
+	if x.sameOwner {
+		if err := os.Lchown(target, h.Uid, h.Gid); err != nil {
+			return err
+		}
+	}
+	// chown(2) clears setuid bits and file capabilities, so they are restored after it.
+	if h.Typeflag != tar.TypeSymlink && h.Typeflag != tar.TypeDir {
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	}
+	if err := setXattrs(target, h, x.sameOwner); err != nil {
+		return err
+	}
+	if h.Typeflag == tar.TypeDir {
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return err
+		}
+		x.dirs = append(x.dirs, directory{path: target, header: h, fi: fi})
+		return nil
+	}
+	return lutimes(target, h)
+}
+
+// extracted reports whether target matches the entry h.
+func (x *extractor) extracted(target string, h *tar.Header) bool {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return false
+	}
+	if h.Typeflag == tar.TypeLink {
+		linkname, ok := clean(h.Linkname)
+		if !ok {
+			return false
+		}
+		source, err := x.resolve(linkname)
+		if err != nil {
+			return false
+		}
+		sfi, err := os.Lstat(source)
+		return err == nil && os.SameFile(fi, sfi)
+	}
+	mode := h.FileInfo().Mode()
+	if fi.Mode()&os.ModeType != mode&os.ModeType {
+		return false
+	}
+	// Directories are completed at the end, so their mode and times are restored again.
+	if h.Typeflag == tar.TypeDir {
+		return false
+	}
+	if x.sameOwner && !sameOwner(fi, h) {
+		return false
+	}
+	if !fi.ModTime().Equal(h.ModTime) {
+		return false
+	}
+	switch h.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return fi.Mode() == mode && fi.Size() == h.Size
+	case tar.TypeSymlink:
+		linkname, err := os.Readlink(target)
+		return err == nil && linkname == h.Linkname
+	case tar.TypeChar, tar.TypeBlock:
+		return fi.Mode() == mode && sameDevice(fi, h)
+	}
+	return fi.Mode() == mode
+}
+
+func (x *extractor) reject(entry string) {
+	log.Infof("Refused to extract %s: it escapes the destination", entry)
+	x.unsafe = append(x.unsafe, entry)
+}
+
+// isSparse reports whether an entry is a sparse file in the GNU formats.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, paxGNUSparsePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes a regular file. The holes of a sparse entry are left as holes:
+// tar.Reader expands them into zeros, so every block of zeros of a sparse entry is
+// skipped, as `cp --sparse=always` does. Other entries are written in full.
+func writeFile(target string, r io.Reader, size int64, sparse bool) error {
+	// The target has been removed, so O_EXCL ensures nothing is written through a symlink.
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zero := make([]byte, blockSize)
+	buf := make([]byte, blockSize)
+	var written int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		written += int64(n)
+		if n > 0 {
+			if sparse && bytes.Equal(buf[:n], zero[:n]) {
+				if _, err := f.Seek(int64(n), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		// The last block of the entry is short, but an archive cut in the middle of the entry
+		// must fail rather than leave a file padded with zeros to look complete to Resume.
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && written == size {
+			break
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Extend the file up to its size if it ends with a hole.
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// xattrs returns the extended attributes recorded for an entry.
+func xattrs(h *tar.Header) map[string]string {
+	attrs := map[string]string{}
+	for k, v := range h.Xattrs {
+		attrs[k] = v
+	}
+	for k, v := range h.PAXRecords {
+		if strings.HasPrefix(k, paxXattrPrefix) {
+			attrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+		}
+	}
+	return attrs
+}
+
+func accessTime(h *tar.Header) time.Time {
+	if h.AccessTime.IsZero() {
+		return h.ModTime
+	}
+	return h.AccessTime
+}
@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"archive/tar"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+func mknod(target string, h *tar.Header) error {
+	mode := uint32(h.Mode & 07777)
+	switch h.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	case tar.TypeFifo:
+		return unix.Mkfifo(target, mode)
+	}
+	return unix.Mknod(target, mode, osutil.Mkdev(h.Devmajor, h.Devminor))
+}
+
+// setXattrs sets the extended attributes of an entry. Unless privileged, attributes
+// in the security and trusted namespaces, which only root may set, are skipped
+// with a warning.
+func setXattrs(target string, h *tar.Header, privileged bool) error {
+	for k, v := range xattrs(h) {
+		if err := unix.Lsetxattr(target, k, []byte(v), 0); err != nil {
+			// Like tar, ignore attributes the filesystem does not support.
+			if err == syscall.ENOTSUP {
+				continue
+			}
+			if err == syscall.EPERM && !privileged && (strings.HasPrefix(k, "security.") || strings.HasPrefix(k, "trusted.")) {
+				log.Infof("Cannot set %s of %s: %v", k, h.Name, err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func lutimes(target string, h *tar.Header) error {
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(accessTime(h).UnixNano()),
+		unix.NsecToTimespec(h.ModTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func sameOwner(fi os.FileInfo, h *tar.Header) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == h.Uid && int(st.Gid) == h.Gid
+}
+
+func sameDevice(fi os.FileInfo, h *tar.Header) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Rdev) == osutil.Mkdev(h.Devmajor, h.Devminor)
+}
@@ -0,0 +1,242 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	fp "path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// netRawCapability is the security.capability value of `setcap cap_net_raw+ep`.
+func netRawCapability() string {
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b[0:], 0x02000000|0x1) // VFS_CAP_REVISION_2 | VFS_CAP_FLAGS_EFFECTIVE
+	binary.LittleEndian.PutUint32(b[4:], 1<<13)          // permitted CAP_NET_RAW
+	return string(b)
+}
+
+func TestExtract(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("extracting owners and device nodes requires root")
+	}
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2017, 6, 19, 1, 32, 42, 0, time.UTC)
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "srv/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 1000, Gid: 1000, ModTime: mtime}},
+		testEntry{header: &tar.Header{Name: "srv/app", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 1001, ModTime: mtime,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.comment": "droot"}}, body: []byte("app")},
+		testEntry{header: &tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime,
+			PAXRecords: map[string]string{paxXattrPrefix + "security.capability": netRawCapability()}}, body: []byte("ping")},
+		testEntry{header: &tar.Header{Name: "bin/ping6", Typeflag: tar.TypeLink, Linkname: "bin/ping"}},
+		testEntry{header: &tar.Header{Name: "bin/su", Typeflag: tar.TypeReg, Mode: 04755, Uid: 0, Gid: 0, ModTime: mtime}, body: []byte("su")},
+		testEntry{header: &tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox", ModTime: mtime}},
+		testEntry{header: &tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testEntry{header: &tar.Header{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0660, Gid: 6, Devmajor: 7, Devminor: 0}},
+		testEntry{header: &tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600, Uid: 1000}},
+	)
+
+	if err := Extract(archive, dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	stat := func(name string) *syscall.Stat_t {
+		fi, err := os.Lstat(fp.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s should be extracted: %v", name, err)
+		}
+		return fi.Sys().(*syscall.Stat_t)
+	}
+
+	cases := []struct {
+		name     string
+		mode     uint32
+		uid, gid uint32
+		rdev     int
+	}{
+		{"srv", syscall.S_IFDIR | 0750, 1000, 1000, 0},
+		{"srv/app", syscall.S_IFREG | 0640, 1000, 1001, 0},
+		{"bin/ping", syscall.S_IFREG | 0755, 0, 0, 0},
+		{"bin/su", syscall.S_IFREG | syscall.S_ISUID | 0755, 0, 0, 0},
+		{"bin/sh", syscall.S_IFLNK | 0777, 0, 0, 0},
+		{"dev/null", syscall.S_IFCHR | 0666, 0, 0, 1*256 + 3},
+		{"dev/loop0", syscall.S_IFBLK | 0660, 0, 6, 7 * 256},
+		{"run/fifo", syscall.S_IFIFO | 0600, 1000, 0, 0},
+	}
+	for _, c := range cases {
+		st := stat(c.name)
+		if st.Mode != c.mode {
+			t.Errorf("%s: mode should be %o: got %o", c.name, c.mode, st.Mode)
+		}
+		if st.Uid != c.uid || st.Gid != c.gid {
+			t.Errorf("%s: owner should be %d:%d: got %d:%d", c.name, c.uid, c.gid, st.Uid, st.Gid)
+		}
+		if int(st.Rdev) != c.rdev {
+			t.Errorf("%s: device should be %d: got %d", c.name, c.rdev, st.Rdev)
+		}
+	}
+
+	for _, name := range []string{"srv", "srv/app", "bin/sh"} {
+		if st := stat(name); time.Unix(st.Mtim.Unix()).UTC() != mtime {
+			t.Errorf("%s: mtime should be %v: got %v", name, mtime, time.Unix(st.Mtim.Unix()).UTC())
+		}
+	}
+
+	if stat("bin/ping").Ino != stat("bin/ping6").Ino {
+		t.Error("bin/ping6 should be a hard link to bin/ping")
+	}
+	if target, _ := os.Readlink(fp.Join(dir, "bin/sh")); target != "busybox" {
+		t.Errorf("bin/sh should link to busybox: got %s", target)
+	}
+
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(fp.Join(dir, "bin/ping"), "security.capability", buf)
+	if err != nil || string(buf[:n]) != netRawCapability() {
+		t.Errorf("bin/ping should keep its file capabilities: %v", err)
+	}
+	if n, err := unix.Lgetxattr(fp.Join(dir, "srv/app"), "user.comment", buf); err != syscall.ENOTSUP && (err != nil || string(buf[:n]) != "droot") {
+		t.Errorf("srv/app should keep its xattrs: %v", err)
+	}
+}
+
+// makeSparseArchive makes an archive of a GNU sparse entry in the PAX 0.1 format,
+// which tar.Writer can not write, whose only data is the fragment at offset,
+// followed by a regular entry of zeros.
+func makeSparseArchive(t *testing.T, name string, size, offset int64, data []byte) *bytes.Buffer {
+	records := ""
+	for _, kv := range [][2]string{
+		{"GNU.sparse.name", name},
+		{"GNU.sparse.size", strconv.FormatInt(size, 10)},
+		{"GNU.sparse.numblocks", "1"},
+		{"GNU.sparse.map", fmt.Sprintf("%d,%d", offset, len(data))},
+	} {
+		record := " " + kv[0] + "=" + kv[1] + "\n"
+		n := len(record)
+		for len(strconv.Itoa(n))+len(record) != n {
+			n = len(strconv.Itoa(n)) + len(record)
+		}
+		records += strconv.Itoa(n) + record
+	}
+	// The PAX header is written as a regular entry, whose type is changed afterwards.
+	buf := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "PaxHeaders/" + name, Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatUSTAR}, body: []byte(records)},
+		testEntry{header: &tar.Header{Name: "GNUSparseFile/" + name, Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatUSTAR}, body: data},
+		testEntry{header: &tar.Header{Name: "var/zeros.img", Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatUSTAR}, body: make([]byte, 1<<20)},
+	)
+	b := buf.Bytes()
+	b[156] = tar.TypeXHeader
+	copy(b[148:156], "        ")
+	sum := 0
+	for _, c := range b[:512] {
+		sum += int(c)
+	}
+	copy(b[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return buf
+}
+
+func TestExtractSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	size := int64(64 << 20)
+	if err := Extract(makeSparseArchive(t, "var/sparse.img", size, size-4, []byte("data")), dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	stat := func(name string) *syscall.Stat_t {
+		fi, err := os.Lstat(fp.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s should be extracted: %v", name, err)
+		}
+		return fi.Sys().(*syscall.Stat_t)
+	}
+	st := stat("var/sparse.img")
+	if st.Size != size {
+		t.Errorf("var/sparse.img: size should be %d: got %d", size, st.Size)
+	}
+	if st.Blocks*512 >= size {
+		t.Errorf("var/sparse.img should be sparse: %d blocks", st.Blocks)
+	}
+	b, err := ioutil.ReadFile(fp.Join(dir, "var/sparse.img"))
+	if err != nil || !bytes.Equal(b[size-4:], []byte("data")) || !bytes.Equal(b[:size-4], make([]byte, size-4)) {
+		t.Errorf("var/sparse.img should read back the same: %v", err)
+	}
+	// Zeros written in full are not sparse in the archive, so they are extracted in full.
+	if st := stat("var/zeros.img"); st.Blocks*512 < st.Size {
+		t.Errorf("var/zeros.img should not be sparse: %d blocks", st.Blocks)
+	}
+}
+
+// extractUnprivileged extracts entries only root may create as a user other than root.
+func extractUnprivileged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755,
+			PAXRecords: map[string]string{
+				paxXattrPrefix + "security.capability": netRawCapability(),
+				paxXattrPrefix + "trusted.overlay":     "y",
+			}}, body: []byte("ping")},
+		testEntry{header: &tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		testEntry{header: &tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600}},
+	)
+	if err := Extract(archive, dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if b, err := ioutil.ReadFile(fp.Join(dir, "bin/ping")); err != nil || string(b) != "ping" {
+		t.Errorf("bin/ping should be extracted without its privileged xattrs: %q, %v", b, err)
+	}
+	if _, err := os.Lstat(fp.Join(dir, "dev/null")); !os.IsNotExist(err) {
+		t.Errorf("dev/null should be skipped: %v", err)
+	}
+	if fi, err := os.Lstat(fp.Join(dir, "run/fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Errorf("run/fifo should be extracted: %v", err)
+	}
+}
+
+// TestExtractUnprivilegedProcess extracts as nobody in a child process of TestExtractUnprivileged.
+func TestExtractUnprivilegedProcess(t *testing.T) {
+	if os.Getenv("DROOT_TEST_UNPRIVILEGED") != "1" {
+		t.Skip("run by TestExtractUnprivileged")
+	}
+	if err := syscall.Setgid(65534); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setuid(65534); err != nil {
+		t.Fatal(err)
+	}
+	extractUnprivileged(t)
+}
+
+func TestExtractUnprivileged(t *testing.T) {
+	if os.Geteuid() != 0 {
+		extractUnprivileged(t)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExtractUnprivilegedProcess$", "-test.v")
+	cmd.Env = append(os.Environ(), "DROOT_TEST_UNPRIVILEGED=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("should not be error: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,33 @@
+// +build !linux
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func mknod(target string, h *tar.Header) error {
+	return fmt.Errorf("archive: mknod not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func setXattrs(target string, h *tar.Header, privileged bool) error {
+	return nil
+}
+
+func lutimes(target string, h *tar.Header) error {
+	if h.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	return os.Chtimes(target, accessTime(h), h.ModTime)
+}
+
+func sameOwner(fi os.FileInfo, h *tar.Header) bool {
+	return false
+}
+
+func sameDevice(fi os.FileInfo, h *tar.Header) bool {
+	return false
+}
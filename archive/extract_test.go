@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	fp "path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+type testEntry struct {
+	header *tar.Header
+	body   []byte
+}
+
+func makeArchive(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		if e.header.Typeflag == tar.TypeReg && e.header.Size == 0 {
+			e.header.Size = int64(len(e.body))
+		}
+		if err := w.WriteHeader(e.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestExtractConfined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := fp.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "../../evil", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("evil")},
+		testEntry{header: &tar.Header{Name: "etc/../../evil", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("evil")},
+		testEntry{header: &tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("root")},
+		testEntry{header: &tar.Header{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."}},
+		testEntry{header: &tar.Header{Name: "up/evil", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("evil")},
+		testEntry{header: &tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: dir}},
+		testEntry{header: &tar.Header{Name: "abs/evil", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("evil")},
+		testEntry{header: &tar.Header{Name: "secret", Typeflag: tar.TypeSymlink, Linkname: "../secret"}},
+		testEntry{header: &tar.Header{Name: "secret", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("overwritten")},
+		testEntry{header: &tar.Header{Name: "shadow", Typeflag: tar.TypeLink, Linkname: "../secret"}},
+	)
+
+	err = Extract(archive, root)
+	unsafe, ok := err.(*UnsafeEntriesError)
+	if !ok {
+		t.Fatalf("should be an UnsafeEntriesError: %v", err)
+	}
+	expected := []string{"../../evil", "etc/../../evil", "shadow -> ../secret"}
+	if diff := pretty.Compare(expected, unsafe.Entries); diff != "" {
+		t.Errorf("unsafe entries diff: (-expected +got)\n%s", diff)
+	}
+
+	if _, err := os.Lstat(fp.Join(dir, "evil")); !os.IsNotExist(err) {
+		t.Errorf("nothing should be written outside of the root: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(fp.Join(dir, "secret")); string(b) != "secret" {
+		t.Errorf("files outside of the root should not be overwritten: got %q", b)
+	}
+	for name, body := range map[string]string{
+		"etc/passwd":      "root",
+		"evil":            "evil",
+		dir[1:] + "/evil": "evil",
+		"secret":          "overwritten",
+	} {
+		b, err := ioutil.ReadFile(fp.Join(root, name))
+		if err != nil || string(b) != body {
+			t.Errorf("%s should be extracted into the root: %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestExtractReplacedDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, victim := fp.Join(dir, "root"), fp.Join(dir, "victim")
+	for _, d := range []string{root, victim} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The directory is replaced by a symlink before its mode and times are restored.
+	mtime := time.Date(2017, 6, 19, 1, 32, 42, 0, time.UTC)
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: mtime}},
+		testEntry{header: &tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: victim}},
+	)
+	if err := Extract(archive, root); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	fi, err := os.Stat(victim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0700 || fi.ModTime().Equal(mtime) {
+		t.Errorf("the directory outside of the root should not be changed: %v %v", fi.Mode(), fi.ModTime())
+	}
+	if target, _ := os.Readlink(fp.Join(root, "a")); target != victim {
+		t.Errorf("a should be a symlink to %s: got %s", victim, target)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mtime := time.Date(2017, 6, 19, 1, 32, 42, 0, time.UTC)
+	entries := []testEntry{
+		{header: &tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime}},
+		{header: &tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, body: []byte("droot")},
+		{header: &tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, body: []byte("127.0.0.1 localhost")},
+		{header: &tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC", ModTime: mtime}},
+	}
+	archive := makeArchive(t, entries...).Bytes()
+	// An interrupted run extracted some entries, and left a partly written file.
+	if err := Extract(bytes.NewReader(makeArchive(t, entries[:2]...).Bytes()), dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, "etc/hosts"), []byte("127.0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fp.Join(dir, "etc/hostname"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Resume(bytes.NewReader(archive), dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	if rfi, err := os.Stat(fp.Join(dir, "etc/hostname")); err != nil || !os.SameFile(fi, rfi) {
+		t.Errorf("etc/hostname should be skipped: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(fp.Join(dir, "etc/hosts")); string(b) != "127.0.0.1 localhost" {
+		t.Errorf("etc/hosts should be extracted again: got %q", b)
+	}
+	if target, _ := os.Readlink(fp.Join(dir, "etc/localtime")); target != "/usr/share/zoneinfo/UTC" {
+		t.Errorf("etc/localtime should be extracted: got %s", target)
+	}
+}
+
+func TestResumeTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	body := bytes.Repeat([]byte("droot"), 1<<20/5)
+	mtime := time.Date(2017, 6, 19, 1, 32, 42, 0, time.UTC)
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, ModTime: mtime}, body: body},
+	).Bytes()
+	// The archive is cut in the middle of the entry.
+	if err := Extract(bytes.NewReader(archive[:300*1024]), dir); err == nil {
+		t.Fatal("should be error")
+	}
+
+	if err := Resume(bytes.NewReader(archive), dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(fp.Join(dir, "large")); !bytes.Equal(b, body) {
+		t.Errorf("large should be extracted again: got %d bytes", len(b))
+	}
+}
+
+func TestExtractLeadingSlash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := new(bytes.Buffer)
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	archive := makeArchive(t,
+		testEntry{header: &tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{header: &tar.Header{Name: "./etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{header: &tar.Header{Name: "//etc/passwd", Typeflag: tar.TypeReg, Mode: 0644}, body: []byte("root")},
+	)
+	if err := Extract(archive, dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(out.String(), "Removing leading '/' from //etc/passwd\n"); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -35,6 +35,12 @@ var commandArgs = map[string]string{
 	"export": commands.CommandArgExport,
 	"run":    commands.CommandArgRun,
 	"umount": commands.CommandArgUmount,
+	"volume": commands.CommandArgVolume,
+
+	"volume create":  commands.CommandArgVolumeCreate,
+	"volume ls":      commands.CommandArgVolumeLs,
+	"volume rm":      commands.CommandArgVolumeRm,
+	"volume inspect": commands.CommandArgVolumeInspect,
 }
 
 func setDebugOutputLevel() {
@@ -58,8 +64,12 @@ func setDebugOutputLevel() {
 func init() {
 	setDebugOutputLevel()
 	argsTemplate := "{{if false}}"
-	for _, command := range append(commands.Commands) {
+	for _, command := range commands.Commands {
 		argsTemplate = argsTemplate + fmt.Sprintf("{{else if (eq .Name %q)}}%s %s", command.Name, command.Name, commandArgs[command.Name])
+		for _, sub := range command.Subcommands {
+			name := command.Name + " " + sub.Name
+			argsTemplate = argsTemplate + fmt.Sprintf("{{else if (eq .Name %q)}}%s %s", sub.Name, name, commandArgs[name])
+		}
 	}
 	argsTemplate = argsTemplate + "{{end}}"
 
@@ -10,6 +10,7 @@ var Commands = []cli.Command{
 	CommandExport,
 	CommandRun,
 	CommandUmount,
+	CommandVolume,
 }
 
 func fatalOnError(command func(context *cli.Context) error) func(context *cli.Context) {
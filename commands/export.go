@@ -1,10 +1,10 @@
 package commands
 
 import (
-	"archive/tar"
 	"context"
 	"fmt"
 	"github.com/asmyasnikov/droot/systemd"
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/mount"
 	"io"
 	"io/ioutil"
@@ -16,17 +16,29 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
+	"github.com/asmyasnikov/droot/archive"
 	"github.com/asmyasnikov/droot/docker"
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/image"
+	"github.com/asmyasnikov/droot/manifest"
 )
 
-var CommandArgExport = "[-o {OUTPUT_DIRECTORY,OUTPUT_TAR_FILE}] [-i SYSTEMD_SERVICE_NAME] {IMAGE[:TAG],CONTAINER}"
+var CommandArgExport = "[-o {OUTPUT_DIRECTORY,OUTPUT_TAR_FILE}] [--compress {gzip,zstd,xz,lz4}] [-i SYSTEMD_SERVICE_NAME] [--start] [--resume] [-e KEY=VALUE] {IMAGE[:TAG],CONTAINER,oci:LAYOUT_DIRECTORY[:TAG],docker-archive:FILE[:REPO:TAG],rootfs:FILE,registry://HOST/REPO[:TAG]}"
 var CommandExport = cli.Command{
 	Name:   "export",
 	Usage:  "Export a container's filesystem as a tar archive or directory",
 	Action: fatalOnError(doExport),
 	Flags: []cli.Flag{
-		cli.StringFlag{Name: "o, output", Usage: "Write to a file, instead of STDOUT"},
+		cli.StringFlag{Name: "o, output", Usage: "Write to a file (.tar, .tar.gz, .tgz, .tar.zst, .tar.xz or .tar.lz4) or a directory, instead of STDOUT"},
+		cli.StringFlag{Name: "compress", Usage: "Compress STDOUT with gzip, zstd, xz or lz4"},
 		cli.StringFlag{Name: "i, install", Usage: "Install container as systemd service (if output is a directory)"},
+		cli.StringSliceFlag{
+			Name:  "env, e",
+			Value: &cli.StringSlice{},
+			Usage: "Override environment variables of the container (can be specifies multiple times)",
+		},
+		cli.BoolFlag{Name: "start", Usage: "Start an existing stopped container before export (images are never started)"},
+		cli.BoolFlag{Name: "resume", Usage: "Continue an interrupted export into a directory, skipping entries already extracted"},
 	},
 }
 
@@ -48,7 +60,7 @@ func outType(output string) (OutType, error) {
 		if os.IsNotExist(err) {
 			err = nil
 		}
-		if strings.HasSuffix(output, ".tar") {
+		if _, ok := archive.CompressionFromPath(output); ok {
 			return TAR, err
 		} else {
 			return DIR, err
@@ -64,118 +76,186 @@ func outType(output string) (OutType, error) {
 	return DIR, nil
 }
 
-func read(reader io.Reader, output string) error {
+func read(reader io.Reader, output string, compression archive.Compression, resume bool) error {
 	oType, err := outType(output)
 	if err != nil {
 		return err
 	}
 	switch oType {
 	case PIPE:
-		if _, err := io.Copy(os.Stdout, reader); err != nil {
-			return err
-		}
-		return nil
+		return write(os.Stdout, reader, compression)
 	case TAR:
-		file, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		if _, err := io.Copy(file, reader); err != nil {
-			return err
-		}
-		return nil
+		compression, _ := archive.CompressionFromPath(output)
+		return writeFile(reader, output, compression)
 	case DIR:
-		if err := os.MkdirAll(output, 0755); err != nil {
+		return extract(reader, output, resume)
+	default:
+		return fmt.Errorf("Not supported output format %s", oType)
+	}
+}
+
+// writeFile writes the archive from reader into a temporary file next to output, and
+// renames it into output once the whole archive is written, so a failed export leaves
+// no partly written file behind.
+func writeFile(reader io.Reader, output string, compression archive.Compression) error {
+	output = filepath.Clean(output)
+	file, err := ioutil.TempFile(filepath.Dir(output), "."+filepath.Base(output)+".droot-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if err := write(file, reader, compression); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), output); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s to %s", file.Name(), output)
+	}
+	return nil
+}
+
+// stagingDir returns the directory next to output which an archive is extracted into.
+func stagingDir(output string) string {
+	output = filepath.Clean(output)
+	return filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".droot-export")
+}
+
+// extract extracts the archive from reader into a staging directory, and renames it
+// into output once the whole archive is extracted, so output is never partly populated.
+// The staging directory of a failed export is kept to be continued with resume.
+func extract(reader io.Reader, output string, resume bool) error {
+	staging := stagingDir(output)
+	if !resume {
+		if err := os.RemoveAll(staging); err != nil {
 			return err
 		}
-		tr := tar.NewReader(reader)
-		for {
-			header, err := tr.Next()
-			switch {
-			case err == io.EOF:
-				return nil
-			case err != nil:
-				return err
-			case header == nil:
-				continue
-			}
-			target := filepath.Join(output, header.Name)
-			switch header.Typeflag {
-			case tar.TypeDir:
-				if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-					return err
-				}
-			case tar.TypeReg:
-				f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, os.FileMode(header.Mode))
-				if err != nil {
-					return err
-				}
-				if _, err := io.Copy(f, tr); err != nil {
-					return err
-				}
-				f.Close()
-			case tar.TypeLink:
-				err := os.Link(header.Linkname, target)
-				if err != nil {
-					return err
-				}
-			case tar.TypeSymlink:
-				err := os.Symlink(header.Linkname, target)
-				if err != nil {
-					return err
-				}
-			}
+	}
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+	extractor := archive.Extract
+	if resume {
+		extractor = archive.Resume
+	}
+	if err := extractor(reader, staging); err != nil {
+		if _, ok := err.(*archive.UnsafeEntriesError); ok {
+			os.RemoveAll(staging)
+			return err
 		}
-	default:
-		return fmt.Errorf("Not supported output format %s", oType)
+		return errors.Wrapf(err, "Failed to export into %s, run again with --resume to continue", output)
+	}
+	// rename(2) atomically replaces output if it is an empty directory.
+	if err := os.Rename(staging, output); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s to %s", staging, output)
+	}
+	return nil
+}
+
+// write copies the archive from reader into w, compressing it.
+func write(w io.Writer, reader io.Reader, compression archive.Compression) error {
+	cw, err := archive.Compress(w, compression)
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(cw, reader); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
 }
 
 func doExport(c *cli.Context) error {
 	if len(c.Args()) < 1 {
 		cli.ShowCommandHelp(c, "export")
-		return errors.New("docker imageID/containerID required")
+		return errors.New("docker imageID/containerID or image reference required")
 	}
 	id := c.Args().Get(0)
 	if id == "" {
 		cli.ShowCommandHelp(c, "export")
-		return errors.New("docker imageID/containerID required")
+		return errors.New("docker imageID/containerID or image reference required")
 	}
 	output := c.String("output")
 	oType, err := outType(output)
 	if err != nil {
 		return err
 	}
-	docker, err := docker.New()
+	compression, err := archive.ParseCompression(c.String("compress"))
 	if err != nil {
 		return err
 	}
-	ctx := context.Background()
-	info, needStop, needRemove, err := docker.Inspect(ctx, id)
-	defer func() {
-		if info == nil {
-			return
-		}
-		if needRemove {
-			docker.Remove(ctx, info.ID)
-		} else if needStop {
-			docker.Stop(ctx, info.ID)
-		}
-	}()
-	if err != nil {
+	if c.IsSet("compress") && oType != PIPE {
+		return errors.New("--compress is only for STDOUT, the compression of an output file is detected by its suffix")
+	}
+	if c.Bool("resume") && oType != DIR {
+		return errors.New("--resume is only for an output directory")
+	}
+	// A missing compression tool is reported before a container is created or an image is read.
+	if oType == TAR {
+		compression, _ = archive.CompressionFromPath(output)
+	}
+	if err := archive.CheckCompression(compression); err != nil {
 		return err
 	}
-	reader, err := docker.Export(
-		ctx,
-		info.ID,
-		info,
+	var (
+		info   *types.ContainerJSON
+		reader io.ReadCloser
 	)
-	if err != nil {
-		return err
+	if image.IsReference(id) {
+		src, err := image.Open(id)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if info, err = image.Inspect(src, id); err != nil {
+			return err
+		}
+		if info.Config.Env, err = environ.Override(info.Config.Env, c.StringSlice("env")); err != nil {
+			return err
+		}
+		if reader, err = image.Export(src, info); err != nil {
+			return err
+		}
+	} else {
+		docker, err := docker.New()
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		var needStop, needRemove bool
+		info, needStop, needRemove, err = docker.Inspect(ctx, id, c.Bool("start"))
+		defer func() {
+			if info == nil {
+				return
+			}
+			if needRemove {
+				docker.Remove(ctx, info.ID)
+			} else if needStop {
+				docker.Stop(ctx, info.ID)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+		if info.Config.Env, err = environ.Override(info.Config.Env, c.StringSlice("env")); err != nil {
+			return err
+		}
+		reader, err = docker.Export(
+			ctx,
+			info.ID,
+			info,
+		)
+		if err != nil {
+			return err
+		}
 	}
 	defer reader.Close()
-	if err := read(reader, output); err != nil {
+	if err := read(reader, output, compression, c.Bool("resume")); err != nil {
 		return err
 	}
 	if oType == DIR && c.IsSet("install") {
@@ -183,7 +263,13 @@ func doExport(c *cli.Context) error {
 		if err != nil {
 			return err
 		}
-		systemd.Install(absPath, c.String("install"), info)
+		m, err := manifest.Load(absPath)
+		if err != nil {
+			return err
+		}
+		if err := systemd.Install(absPath, c.String("install"), m); err != nil {
+			return err
+		}
 	}
 	cmd := "\tdroot run [--cp]"
 	if len(info.Config.User) > 0 {
@@ -194,11 +280,15 @@ func doExport(c *cli.Context) error {
 	}
 	attentions := ""
 	for _, m := range info.Mounts {
+		// Volumes are recorded in the manifest, and mounted from the volume store of droot.
+		if m.Type == mount.TypeVolume {
+			continue
+		}
 		if m.Type != mount.TypeBind {
 			attentions += "\tmount point " + m.Source + ":" + m.Destination + " is a " + string(m.Type) + "\n"
 			continue
 		}
-		cmd += m.Source + ":" + m.Destination + func() string {
+		cmd += " --bind " + m.Source + ":" + m.Destination + func() string {
 			if !m.RW {
 				return ":ro"
 			}
@@ -221,9 +311,6 @@ func doExport(c *cli.Context) error {
 		}
 		attentions += "\tcontainer have address " + n.IPAddress + " with network gateway " + n.Gateway + "\n"
 	}
-	if len(info.Config.WorkingDir) > 0 {
-		attentions += "\tcontainer have working directory " + info.Config.WorkingDir + "\n"
-	}
 	for _, l := range info.HostConfig.Ulimits {
 		attentions += "\tcontainer have ulimit " + l.String() + "\n"
 	}
@@ -243,7 +330,8 @@ func doExport(c *cli.Context) error {
 		}
 		return "[container directory]"
 	}()
-	cmd += " -- " + strings.Join(append(info.Config.Entrypoint, info.Config.Cmd...), " ") + "\n"
+	// The entrypoint, cmd and working directory are recorded in the manifest, so run needs no command.
+	cmd += "\n"
 	fmt.Fprintln(os.Stderr, "Run droot with command (save this for future use):")
 	fmt.Fprintln(os.Stderr, cmd)
 	if len(attentions) > 0 {
@@ -1,20 +1,33 @@
 package commands
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"fmt"
+	"github.com/asmyasnikov/droot/archive"
 	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestOutType(t *testing.T) {
 	cases := map[string]struct {
-		t OutType
+		t   OutType
 		err bool
 	}{
-		"":        {PIPE, false},
-		".":       {DIR, true},
-		"out":     {DIR, false},
-		"out.tar": {TAR, false},
+		"":            {PIPE, false},
+		".":           {DIR, true},
+		"out":         {DIR, false},
+		"out.tar":     {TAR, false},
+		"out.tar.gz":  {TAR, false},
+		"out.tgz":     {TAR, false},
+		"out.tar.zst": {TAR, false},
+		"out.tar.xz":  {TAR, false},
+		"out.tar.lz4": {TAR, false},
 	}
 	for output, expected := range cases {
 		oType, err := outType(output)
@@ -26,3 +39,75 @@ func TestOutType(t *testing.T) {
 		require.Equal(t, expected.t, oType, fmt.Sprintf("out <%s> -> %+v", output, expected))
 	}
 }
+
+type failingReader struct {
+	io.Reader
+}
+
+func (r failingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "app")
+
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, name := range []string{"bin/sh", "etc/hostname"} {
+		require.NoError(t, w.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 5}))
+		_, err := w.Write([]byte("droot"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	data := buf.Bytes()
+
+	// The export is interrupted after the first entry.
+	err = extract(failingReader{bytes.NewReader(data[:1024])}, output, false)
+	require.Error(t, err)
+	_, err = os.Stat(output)
+	require.True(t, os.IsNotExist(err), "output should not be populated partly")
+	_, err = os.Stat(filepath.Join(stagingDir(output), "bin/sh"))
+	require.NoError(t, err, "staging directory should be kept")
+
+	require.NoError(t, extract(bytes.NewReader(data), output, true))
+	_, err = os.Stat(stagingDir(output))
+	require.True(t, os.IsNotExist(err), "staging directory should be renamed")
+	b, err := ioutil.ReadFile(filepath.Join(output, "etc/hostname"))
+	require.NoError(t, err)
+	require.Equal(t, "droot", string(b))
+
+	oType, err := outType(output)
+	require.Error(t, err, "output should not be exported twice")
+	require.Equal(t, DIR, oType)
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "app.tar")
+
+	err = read(failingReader{bytes.NewReader([]byte("droot"))}, output, archive.Uncompressed, false)
+	require.Error(t, err)
+	childs, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, childs, "a failed export should leave no file behind")
+
+	require.NoError(t, read(bytes.NewReader([]byte("droot")), output, archive.Uncompressed, false))
+	b, err := ioutil.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, "droot", string(b))
+	info, err := os.Stat(output)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	childs, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, childs, 1)
+}
@@ -2,52 +2,116 @@ package commands
 
 import (
 	"fmt"
-	"golang.org/x/sys/unix"
 	"os"
-	"path"
 	fp "path/filepath"
+	"runtime"
+	"strings"
 
+	"github.com/docker/docker/pkg/term"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
 	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/landlock"
 	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/manifest"
 	"github.com/asmyasnikov/droot/mounter"
 	"github.com/asmyasnikov/droot/osutil"
+	"github.com/asmyasnikov/droot/seccomp"
+	"github.com/asmyasnikov/droot/volume"
 )
 
-var CommandArgRun = "--root ROOT_DIR [--user USER] [--group GROUP] [--bind SRC-PATH[:DEST-PATH][:ro]] [--no-dropcaps] -- COMMAND"
+var CommandArgRun = "--root ROOT_DIR [--user USER[:GROUP]] [--group GROUP] [--group-add GROUP] [--clear-groups] [--bind SRC-PATH[:DEST-PATH][:OPTIONS]] [--volume [NAME:]DEST-PATH[:OPTIONS]] [--tmpfs DEST-PATH[:OPTIONS]] [--read-only] [--device HOST-PATH[:CONTAINER-PATH][:PERMISSIONS]] [--unshare NAMESPACE[,NAMESPACE...]] [--hostname NAME] [--pivot-root] [--overlay [--upper DIR] [--rm]] [--privileged] [--no-dropcaps] [--allow-new-privileges] [--cap-add CAP] [--cap-drop CAP] [--seccomp PROFILE] [--landlock [--landlock-rw DIR]] [--entrypoint ENTRYPOINT] [--workdir DIR] [-- COMMAND [ARG...]]"
 var CommandRun = cli.Command{
 	Name:   "run",
 	Usage:  "Run command in container",
 	Action: fatalOnError(doRun),
 	Flags: []cli.Flag{
 		cli.StringFlag{Name: "root, r", Usage: "Root directory path for chrooting"},
-		cli.StringFlag{Name: "user, u", Usage: "User (ID or name) to switch before running the program"},
-		cli.StringFlag{Name: "group, g", Usage: "Group (ID or name) to switch to"},
+		cli.StringFlag{Name: "user, u", Usage: "User to switch before running the program: USER[:GROUP] or UID[:GID], resolved in the container (default: the user of the image)"},
+		cli.StringFlag{Name: "group, g", Usage: "Group (ID or name) to switch to, instead of the group of --user"},
+		cli.StringSliceFlag{
+			Name:  "group-add",
+			Value: &cli.StringSlice{},
+			Usage: "Add a supplementary group (ID or name) (can be specifies multiple times)",
+		},
+		cli.BoolFlag{Name: "clear-groups", Usage: "Do not set the supplementary groups of the user from /etc/group of the container"},
 		cli.StringSliceFlag{
 			Name:  "bind, b",
 			Value: &cli.StringSlice{},
-			Usage: "Bind mount directory (can be specifies multiple times)",
+			Usage: "Bind mount a file or directory: SRC-PATH[:DEST-PATH][:OPTIONS], with options ro, rw, nosuid, nodev, noexec, [r]shared, [r]slave, [r]private, create=dir|file|none, bind and rbind separated by commas (can be specifies multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "volume, v",
+			Value: &cli.StringSlice{},
+			Usage: "Mount a volume of the volume store of droot, created unless it exists: [NAME:]DEST-PATH[:OPTIONS], anonymous without NAME, with the options of --bind and nocopy (can be specifies multiple times)",
 		},
 		cli.StringSliceFlag{
 			Name:  "robind",
 			Value: &cli.StringSlice{},
 			Usage: "Readonly bind mount directory (can be specifies multiple times)",
 		},
+		cli.StringSliceFlag{
+			Name:  "tmpfs",
+			Value: &cli.StringSlice{},
+			Usage: "Mount a tmpfs: DEST-PATH[:OPTIONS], e.g. /tmp:size=64m,mode=1777 (can be specifies multiple times)",
+		},
+		cli.BoolFlag{Name: "read-only", Usage: "Mount the root directory of the container read-only, except the mounts beneath it"},
+		cli.StringSliceFlag{
+			Name:  "device",
+			Value: &cli.StringSlice{},
+			Usage: "Add a device of the host: HOST-PATH[:CONTAINER-PATH][:PERMISSIONS], e.g. /dev/fuse:rwm (can be specifies multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "unshare",
+			Value: &cli.StringSlice{},
+			Usage: "Run in new namespaces: " + strings.Join(osutil.Namespaces, ",") + " (pid implies mount) (can be specifies multiple times)",
+		},
+		cli.StringFlag{Name: "hostname", Usage: "Hostname of the container, which requires --unshare uts"},
+		cli.BoolFlag{Name: "pivot-root", Usage: "Change the root directory with pivot_root(2) rather than chroot(2), which requires --unshare mount"},
+		cli.BoolFlag{Name: "overlay", Usage: "Run on a copy-on-write overlay of the container, which is only read then"},
+		cli.StringFlag{Name: "upper", Usage: "Directory to write the changes of --overlay to (default: a directory of the run next to the container)"},
+		cli.BoolFlag{Name: "rm", Usage: "Discard the changes of --overlay when the command exits"},
 		cli.BoolFlag{
 			Name:  "copy-files, cp",
 			Usage: "Copy host files to container such as /etc/group, /etc/passwd, /etc/resolv.conf, /etc/hosts",
 		},
+		cli.BoolFlag{Name: "privileged", Usage: "Do not hide sensitive paths of /proc and /sys, and mount them read-write"},
 		cli.BoolFlag{Name: "no-dropcaps", Usage: "Provide COMMAND's process in chroot with root permission (dangerous)"},
+		cli.BoolFlag{Name: "allow-new-privileges", Usage: "Let COMMAND gain privileges by setuid bits or file capabilities (no_new_privs is not set)"},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Value: &cli.StringSlice{},
+			Usage: "Add a capability, e.g. NET_RAW or ALL (can be specifies multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Value: &cli.StringSlice{},
+			Usage: "Drop a capability, e.g. NET_BIND_SERVICE or ALL (can be specifies multiple times)",
+		},
+		cli.BoolFlag{Name: "landlock", Usage: "Allow COMMAND to only read the container, except writable binds, /dev and --landlock-rw, with Landlock"},
+		cli.StringSliceFlag{
+			Name:  "landlock-rw",
+			Value: &cli.StringSlice{},
+			Usage: "Allow writing beneath a directory of the container with --landlock (can be specifies multiple times)",
+		},
+		cli.StringFlag{Name: "seccomp", Usage: "Seccomp profile in the JSON format of Docker, or unconfined (default: the default profile of Docker)"},
 		cli.StringSliceFlag{
 			Name:  "env, e",
 			Value: &cli.StringSlice{},
 			Usage: "Set environment variables",
 		},
+		cli.StringFlag{Name: "entrypoint", Usage: "Overwrite the entrypoint of the container, which also resets its cmd (\"\" clears it)"},
+		cli.StringFlag{Name: "workdir, w", Usage: "Working directory inside the container, instead of the recorded one"},
 	},
 }
 
+// unsharedEnv is set for droot run again in new namespaces.
+const unsharedEnv = "DROOT_UNSHARED"
+
+// overlayEnv is the root directory of droot run again on an overlay.
+const overlayEnv = "DROOT_OVERLAY"
+
 var copyFiles = []string{
 	"etc/group",
 	"etc/passwd",
@@ -55,55 +119,88 @@ var copyFiles = []string{
 	"etc/hosts",
 }
 
-var keepCaps = map[uint]bool{
-	0:  true, // CAP_CHOWN
-	1:  true, // CAP_DAC_OVERRIDE
-	2:  true, // CAP_DAC_READ_SEARCH
-	3:  true, // CAP_FOWNER
-	6:  true, // CAP_SETGID
-	7:  true, // CAP_SETUID
-	10: true, // CAP_NET_BIND_SERVICE
-}
-
 func doRun(c *cli.Context) error {
+	// Credentials, capabilities and the root directory are changed for the calling thread,
+	// which must be the one executing the command.
+	runtime.LockOSThread()
+
 	if len(c.StringSlice("robind")) > 0 {
 		cli.ShowCommandHelp(c, "run")
 		return errors.New("--robind depricated. use --bind HOST_DIR:CONTAINER_DIR[:ro]")
 	}
 
-	command := c.Args()
-	if len(command) < 1 {
-		cli.ShowCommandHelp(c, "run")
-		return errors.New("command required")
-	}
-
 	optRootDir := c.String("root")
 	if optRootDir == "" {
 		cli.ShowCommandHelp(c, "run")
 		return errors.New("--root option required")
 	}
 
-	rootDir, err := mounter.ResolveRootDir(optRootDir)
+	namespaces, err := osutil.ParseNamespaces(c.StringSlice("unshare"))
 	if err != nil {
 		return err
 	}
+	if c.String("hostname") != "" && !osutil.HasNamespace(namespaces, "uts") {
+		return errors.New("--hostname requires --unshare uts")
+	}
+	if (c.IsSet("upper") || c.Bool("rm")) && !c.Bool("overlay") {
+		return errors.New("--upper and --rm require --overlay")
+	}
 
-	env, err := environ.Environ(c.StringSlice("env"), path.Join(rootDir, environ.DROOT_ENV_FILE_PATH))
+	rootDir, err := mounter.ResolveRootDir(optRootDir)
 	if err != nil {
 		return err
 	}
 
-	uid, gid := os.Getuid(), os.Getgid()
-
-	if group := c.String("group"); group != "" {
-		if gid, err = osutil.LookupGroup(group); err != nil {
+	// droot runs itself again on the overlay, or in the new namespaces, which then does the rest.
+	if c.Bool("overlay") && os.Getenv(overlayEnv) == "" {
+		status, err := runOnOverlay(rootDir, c.String("upper"), c.Bool("rm"), namespaces)
+		if err != nil {
 			return err
 		}
+		os.Exit(status)
 	}
-	if user := c.String("user"); user != "" {
-		if uid, err = osutil.LookupUser(user); err != nil {
+	if len(namespaces) > 0 && os.Getenv(unsharedEnv) == "" {
+		env := append(os.Environ(), unsharedEnv+"=1")
+		status, err := osutil.RunInNamespaces(namespaces, "/proc/self/exe", os.Args[1:], env)
+		if err != nil {
 			return err
 		}
+		os.Exit(status)
+	}
+	// Anonymous volumes belong to the container, rather than to the overlay of a run.
+	containerDir := rootDir
+	if dir := os.Getenv(overlayEnv); dir != "" {
+		rootDir = dir
+	}
+
+	m, err := manifest.Load(rootDir)
+	if err != nil {
+		return err
+	}
+
+	env, err := environ.Override(m.Env, c.StringSlice("env"))
+	if err != nil {
+		return err
+	}
+
+	// Without a command, the entrypoint and cmd of the container are run as `docker run` does.
+	var entrypoint *string
+	if c.IsSet("entrypoint") {
+		e := c.String("entrypoint")
+		entrypoint = &e
+	}
+	command, err := m.Command(entrypoint, c.Args())
+	if err != nil {
+		cli.ShowCommandHelp(c, "run")
+		return err
+	}
+
+	workdir := m.WorkingDir
+	if c.IsSet("workdir") {
+		workdir = c.String("workdir")
+	}
+	if workdir != "" && !fp.IsAbs(workdir) {
+		return errors.Errorf("Working directory %s is not an absolute path", workdir)
 	}
 
 	// copy files
@@ -113,84 +210,314 @@ func doRun(c *cli.Context) error {
 			if err := osutil.Cp(srcFile, destFile); err != nil {
 				return errors.Wrapf(err, "Failed to copy %s", f)
 			}
+		}
+	}
+
+	// The user is resolved in the container's own /etc/passwd and /etc/group,
+	// since the host may not know the users of the image.
+	spec := m.User
+	if c.IsSet("user") {
+		spec = c.String("user")
+	}
+	if group := c.String("group"); group != "" {
+		spec = strings.SplitN(spec, ":", 2)[0] + ":" + group
+	}
+	users, err := osutil.ReadPasswd(rootDir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read /etc/passwd of the container")
+	}
+	groups, err := osutil.ReadGroup(rootDir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read /etc/group of the container")
+	}
+	user, err := osutil.ResolveUser(spec, users, groups)
+	if err != nil {
+		return err
+	}
+	uid, gid := user.Uid, user.Gid
+
+	// The capabilities recorded by export are tweaked by the flags, as `docker run` does.
+	caps, err := containerCapabilities(m, c.StringSlice("cap-add"), c.StringSlice("cap-drop"))
+	if err != nil {
+		return err
+	}
+	// A user other than root only keeps the capabilities added explicitly, not the default ones.
+	ambient, err := osutil.TweakCapabilities(nil, append(m.CapAdd, c.StringSlice("cap-add")...), nil)
+	if err != nil {
+		return err
+	}
+
+	// The rules of the profile depend on the capabilities the command runs with.
+	filterCaps := caps
+	if c.Bool("no-dropcaps") {
+		filterCaps, _ = osutil.TweakCapabilities(nil, []string{"ALL"}, nil)
+	}
+	filter, err := seccompFilter(c.String("seccomp"), filterCaps)
+	if err != nil {
+		return err
+	}
+
+	// Supplementary groups are never inherited from droot, which usually runs as root.
+	var gids []int
+	if !c.Bool("clear-groups") {
+		gids = osutil.InitGroups(user, groups)
+	}
+	added, err := osutil.LookupGroups(c.StringSlice("group-add"), groups)
+	if err != nil {
+		return err
+	}
+	gids = append(gids, added...)
+
+	// Like Docker, variables of the container take precedence over the user entry.
+	defaults := []string{"HOME=" + user.Home}
+	if user.Name != "" {
+		defaults = append(defaults, "USER="+user.Name, "LOGNAME="+user.Name)
+	}
+	if env, err = environ.Override(defaults, env); err != nil {
+		return err
+	}
+
+	if c.Bool("copy-files") {
+		for _, f := range copyFiles {
+			destFile := fp.Join(rootDir, f)
 			if err := os.Lchown(destFile, uid, gid); err != nil {
 				return errors.Wrapf(err, "Failed to lchown %s", f)
 			}
 		}
 	}
 
+	// Mounts must not propagate to the host from a mount namespace of the container,
+	// so that they are all gone with it.
+	if osutil.HasNamespace(namespaces, "mount") {
+		if err := osutil.ForceMount("", "/", "none", "rprivate"); err != nil {
+			return errors.Wrapf(err, "Failed to make mounts private")
+		}
+	}
+	if hostname := c.String("hostname"); hostname != "" {
+		if err := osutil.Sethostname(hostname); err != nil {
+			return errors.Wrapf(err, "Failed to set hostname %s", hostname)
+		}
+	}
+	if osutil.HasNamespace(namespaces, "net") {
+		if err := osutil.SetLoopbackUp(); err != nil {
+			return errors.Wrapf(err, "Failed to bring up the loopback interface")
+		}
+	}
+
 	mnt := mounter.NewMounter(rootDir)
 
-	if err := mnt.MountSysProc(); err != nil {
+	if err := mnt.MountSysProc(osutil.HasNamespace(namespaces, "pid")); err != nil {
+		return err
+	}
+
+	// Like Docker, hide the paths of /proc and /sys which expose the host, and protect the others.
+	if !c.Bool("privileged") {
+		maskedPaths, readonlyPaths := mounter.DefaultMaskedPaths, mounter.DefaultReadonlyPaths
+		if m.MaskedPaths != nil {
+			maskedPaths = m.MaskedPaths
+		}
+		if m.ReadonlyPaths != nil {
+			readonlyPaths = m.ReadonlyPaths
+		}
+		if err := mnt.ReadonlyPaths(append([]string{"/sys"}, readonlyPaths...)); err != nil {
+			return err
+		}
+		if err := mnt.MaskPaths(maskedPaths); err != nil {
+			return err
+		}
+	}
+
+	// The command gets the terminal of droot as its console, if droot runs interactively.
+	var console string
+	if term.IsTerminal(os.Stdin.Fd()) {
+		if console, err = os.Readlink("/proc/self/fd/0"); err != nil {
+			return errors.Wrapf(err, "Failed to find the terminal")
+		}
+	}
+	if err := mnt.MountDev(c.StringSlice("device"), console); err != nil {
 		return err
 	}
 
-	if err := mnt.BindMounts(c.StringSlice("bind"), path.Join(rootDir, mounter.DROOT_BINDS_FILE_PATH)); err != nil {
+	// Volumes are bind mounted from the volume store, where they are created on the first run.
+	volumeBinds, err := volume.NewStore(volume.DefaultRoot).Binds(containerDir, rootDir, append(m.Volumes, c.StringSlice("volume")...))
+	if err != nil {
 		return err
 	}
+	if err := mnt.BindMounts(append(append(m.Binds, c.StringSlice("bind")...), volumeBinds...)); err != nil {
+		return err
+	}
+	if err := mnt.TmpfsMounts(append(m.Tmpfs, c.StringSlice("tmpfs")...)); err != nil {
+		return err
+	}
+
+	var rules []landlock.Rule
+	if c.Bool("landlock") {
+		writable := append(mnt.Tmpfs(), c.StringSlice("landlock-rw")...)
+		if rules, err = landlockRules(mnt.Binds(), writable); err != nil {
+			return err
+		}
+	}
 
 	// create symlinks
 	if err := osutil.Symlink("../run/lock", fp.Join(rootDir, "/var/lock")); err != nil {
 		return err
 	}
 
-	if err := createDevices(rootDir, uid, gid); err != nil {
-		return err
+	// Like Docker, create the working directory if the image does not have it.
+	if workdir != "" {
+		if err := os.MkdirAll(fp.Join(rootDir, workdir), 0755); err != nil {
+			return errors.Wrapf(err, "Failed to create working directory %s", workdir)
+		}
+	}
+
+	// The root directory is made read-only last, since droot creates files in it until then.
+	if c.Bool("read-only") || m.ReadonlyRootfs {
+		if err := mnt.MountRootReadonly(); err != nil {
+			return err
+		}
 	}
 
-	if err := osutil.Chroot(rootDir); err != nil {
-		return fmt.Errorf("Failed to chroot: %s", err)
+	// A process with CAP_SYS_CHROOT can escape chroot(2), but not pivot_root(2),
+	// which only a mount namespace of the container can do.
+	if c.Bool("pivot-root") && osutil.HasNamespace(namespaces, "mount") {
+		if err := osutil.PivotRoot(rootDir); err != nil {
+			return fmt.Errorf("Failed to pivot_root: %s", err)
+		}
+	} else {
+		if c.Bool("pivot-root") {
+			log.Info("--pivot-root requires --unshare mount, so the root directory is changed with chroot(2)")
+		}
+		if err := osutil.Chroot(rootDir); err != nil {
+			return fmt.Errorf("Failed to chroot: %s", err)
+		}
 	}
 
-	if !c.Bool("no-dropcaps") {
-		if err := osutil.DropCapabilities(keepCaps); err != nil {
-			return fmt.Errorf("Failed to drop capabilities: %s", err)
+	// Confining the command requires CAP_SYS_ADMIN without no_new_privs, so it is done
+	// before the user is switched and the capabilities are dropped then, as runc does.
+	noNewPrivs := !c.Bool("allow-new-privileges")
+	if !noNewPrivs {
+		if err := confine(rules, filter); err != nil {
+			return err
 		}
 	}
 
-	if err := osutil.Setgid(gid); err != nil {
-		return fmt.Errorf("Failed to set group %d: %s", gid, err)
+	if c.Bool("no-dropcaps") {
+		if err := osutil.SwitchUser(uid, gid, gids); err != nil {
+			return err
+		}
+	} else if err := osutil.DropPrivileges(uid, gid, gids, caps, ambient); err != nil {
+		return err
 	}
-	if err := osutil.Setuid(uid); err != nil {
-		return fmt.Errorf("Failed to set user %d: %s", uid, err)
+
+	if workdir != "" {
+		if err := os.Chdir(workdir); err != nil {
+			return fmt.Errorf("Failed to change directory to %s: %s", workdir, err)
+		}
+	}
+
+	// Otherwise the command is confined last, so that the filter only has to allow the command.
+	if noNewPrivs {
+		if err := osutil.SetNoNewPrivileges(); err != nil {
+			return fmt.Errorf("Failed to set no_new_privs: %s", err)
+		}
+		if err := confine(rules, filter); err != nil {
+			return err
+		}
 	}
 
 	return osutil.Execv(command[0], command[0:], env)
 }
 
-
-func createDevices(rootDir string, uid, gid int) error {
-	nullDir := fp.Join(rootDir, os.DevNull)
-	if err := osutil.Mknod(nullDir, unix.S_IFCHR|uint32(os.FileMode(0666)), 1*256+3); err != nil {
-		return err
+// runOnOverlay runs droot again on an overlay of rootDir, in the namespaces if any, and returns its exit status.
+// droot waits for it to unmount the overlay, and to discard its upper directory if remove is set.
+func runOnOverlay(rootDir, upperDir string, remove bool, namespaces []string) (int, error) {
+	o, err := mounter.NewOverlay(rootDir, upperDir)
+	if err != nil {
+		return 0, err
 	}
-
-	if err := os.Lchown(nullDir, uid, gid); err != nil {
-		log.Debugf("Failed to lchown %s: %s\n", nullDir, err)
-		return err
+	if err := o.Mount(); err != nil {
+		o.Remove(remove)
+		return 0, err
 	}
 
-	zeroDir := fp.Join(rootDir, "/dev/zero")
-	if err := osutil.Mknod(zeroDir, unix.S_IFCHR|uint32(os.FileMode(0666)), 1*256+3); err != nil {
-		return err
+	env := append(os.Environ(), overlayEnv+"="+o.MergedDir)
+	if len(namespaces) > 0 {
+		env = append(env, unsharedEnv+"=1")
 	}
+	status, err := osutil.RunInNamespaces(namespaces, "/proc/self/exe", os.Args[1:], env)
+	if rmErr := o.Remove(remove); rmErr != nil {
+		if err != nil {
+			log.Info(rmErr)
+			return 0, err
+		}
+		return 0, rmErr
+	}
+	return status, err
+}
 
-	if err := os.Lchown(zeroDir, uid, gid); err != nil {
-		log.Debugf("Failed to lchown %s: %s\n", zeroDir, err)
-		return err
+// seccompFilter compiles the seccomp profile at path, the default profile of Docker if path is empty.
+// No filter is returned for unconfined.
+func seccompFilter(path string, caps map[uint]bool) ([]seccomp.Instruction, error) {
+	if path == "unconfined" {
+		return nil, nil
+	}
+	profile := seccomp.DefaultProfile()
+	if path != "" {
+		var err error
+		if profile, err = seccomp.Load(path); err != nil {
+			return nil, err
+		}
 	}
+	filter, err := seccomp.Compile(profile, caps)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to compile seccomp profile")
+	}
+	return filter, nil
+}
 
-	for _, f := range []string{"/dev/random", "/dev/urandom"} {
-		randomDir := fp.Join(rootDir, f)
-		if err := osutil.Mknod(randomDir, unix.S_IFCHR|uint32(os.FileMode(0666)), 1*256+9); err != nil {
-			return err
+// landlockRules returns the Landlock rules of the container: it can be read as a whole,
+// and written beneath writable binds, /dev, and the directories writable.
+func landlockRules(binds []mounter.Bind, writable []string) ([]landlock.Rule, error) {
+	rules := []landlock.Rule{{Path: "/"}, {Path: "/dev", Writable: true}}
+	for _, b := range binds {
+		if b.RW {
+			rules = append(rules, landlock.Rule{Path: b.ContainerDir, Writable: true})
 		}
+	}
+	for _, dir := range writable {
+		if !fp.IsAbs(dir) {
+			return nil, errors.Errorf("%s is not an absolute path", dir)
+		}
+		rules = append(rules, landlock.Rule{Path: fp.Clean(dir), Writable: true})
+	}
+	return rules, nil
+}
 
-		if err := os.Lchown(randomDir, uid, gid); err != nil {
-			log.Debugf("Failed to lchown %s: %s\n", randomDir, err)
+// confine restricts the files the calling thread can access with rules of Landlock, if any,
+// and its syscalls with filter, if any. Landlock is skipped on kernels without it.
+func confine(rules []landlock.Rule, filter []seccomp.Instruction) error {
+	if rules != nil {
+		if err := landlock.Restrict(rules); err == landlock.ErrNotSupported {
+			log.Info("Landlock is not supported by the kernel, so the command is not confined by --landlock")
+		} else if err != nil {
 			return err
 		}
 	}
-
+	if filter != nil {
+		return seccomp.Install(filter)
+	}
 	return nil
 }
+
+// containerCapabilities returns the capabilities of the container: the default ones of droot,
+// tweaked by the capabilities added and dropped at export, and by add and drop then.
+func containerCapabilities(m *manifest.Manifest, add, drop []string) (map[uint]bool, error) {
+	caps, err := osutil.TweakCapabilities(nil, osutil.DefaultCapabilities, nil)
+	if err != nil {
+		return nil, err
+	}
+	if caps, err = osutil.TweakCapabilities(caps, m.CapAdd, m.CapDrop); err != nil {
+		return nil, err
+	}
+	return osutil.TweakCapabilities(caps, add, drop)
+}
@@ -0,0 +1,151 @@
+package commands
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/asmyasnikov/droot/landlock"
+	"github.com/asmyasnikov/droot/manifest"
+	"github.com/asmyasnikov/droot/mounter"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// TestSwitchUserProcess is not a real test: it switches the user as `droot run` does,
+// and executes a command which prints its credentials.
+func TestSwitchUserProcess(t *testing.T) {
+	mode := os.Getenv("DROOT_TEST_SWITCH_USER")
+	if mode == "" {
+		return
+	}
+	runtime.LockOSThread()
+	var err error
+	switch mode {
+	case "groups":
+		err = osutil.SwitchUser(1234, 1234, []int{1234, 33, 4321})
+	case "caps":
+		caps := map[uint]bool{10: true} // CAP_NET_BIND_SERVICE
+		err = osutil.DropPrivileges(1234, 1234, []int{1234}, caps, caps)
+		if err == nil {
+			err = osutil.SetNoNewPrivileges()
+		}
+	case "defaults":
+		var caps map[uint]bool
+		caps, err = containerCapabilities(&manifest.Manifest{}, nil, nil)
+		if err == nil {
+			err = osutil.DropPrivileges(1234, 1234, []int{1234}, caps, nil)
+		}
+	}
+	if err != nil {
+		os.Stderr.WriteString(err.Error())
+		os.Exit(2)
+	}
+	osutil.Execv("cat", []string{"cat", "/proc/self/status"}, []string{"PATH=/usr/bin:/bin"})
+	os.Exit(3)
+}
+
+// processStatus runs TestSwitchUserProcess and returns the status of the executed command.
+func processStatus(t *testing.T, mode string) map[string]string {
+	if os.Geteuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestSwitchUserProcess")
+	cmd.Env = append(os.Environ(), "DROOT_TEST_SWITCH_USER="+mode)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+
+	status := map[string]string{}
+	for _, l := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) == 2 {
+			status[kv[0]] = strings.Join(strings.Fields(kv[1]), " ")
+		}
+	}
+	return status
+}
+
+func TestSwitchUser(t *testing.T) {
+	status := processStatus(t, "groups")
+	require.Equal(t, "1234 1234 1234 1234", status["Uid"])
+	require.Equal(t, "1234 1234 1234 1234", status["Gid"])
+	require.Equal(t, "33 1234 4321", status["Groups"], "the groups of root should not be inherited")
+}
+
+func TestDropPrivileges(t *testing.T) {
+	status := processStatus(t, "caps")
+	require.Equal(t, "1234 1234 1234 1234", status["Uid"])
+	for _, set := range []string{"CapInh", "CapPrm", "CapEff", "CapBnd", "CapAmb"} {
+		require.Equal(t, "0000000000000400", status[set], set+" should only have CAP_NET_BIND_SERVICE")
+	}
+	require.Equal(t, "1", status["NoNewPrivs"])
+}
+
+func TestDropPrivilegesDefaults(t *testing.T) {
+	status := processStatus(t, "defaults")
+	require.Equal(t, "1234 1234 1234 1234", status["Uid"])
+	for _, set := range []string{"CapInh", "CapPrm", "CapEff", "CapAmb"} {
+		require.Equal(t, "0000000000000000", status[set], set+" should not have the default capabilities")
+	}
+	require.Equal(t, "00000000000004cf", status["CapBnd"], "CapBnd should have the default capabilities")
+}
+
+func TestContainerCapabilities(t *testing.T) {
+	m := &manifest.Manifest{CapAdd: []string{"NET_RAW"}, CapDrop: []string{"CAP_CHOWN"}}
+	caps, err := containerCapabilities(m, []string{"sys_time"}, []string{"NET_RAW", "DAC_OVERRIDE"})
+	require.NoError(t, err)
+	// DAC_READ_SEARCH, FOWNER, SETGID, SETUID, NET_BIND_SERVICE and SYS_TIME
+	require.Equal(t, map[uint]bool{2: true, 3: true, 6: true, 7: true, 10: true, 25: true}, caps)
+
+	caps, err = containerCapabilities(m, []string{"NET_BIND_SERVICE"}, []string{"ALL"})
+	require.NoError(t, err)
+	require.Equal(t, map[uint]bool{10: true}, caps)
+
+	caps, err = containerCapabilities(&manifest.Manifest{}, []string{"ALL"}, []string{"SYS_ADMIN"})
+	require.NoError(t, err)
+	require.Len(t, caps, 40)
+	require.False(t, caps[21])
+
+	// ALL in --cap-add takes precedence over ALL in --cap-drop, like Docker.
+	caps, err = containerCapabilities(&manifest.Manifest{}, []string{"ALL"}, []string{"ALL", "SYS_ADMIN"})
+	require.NoError(t, err)
+	require.Len(t, caps, 40)
+	require.False(t, caps[21])
+
+	_, err = containerCapabilities(m, []string{"NO_SUCH_CAP"}, nil)
+	require.Error(t, err)
+}
+
+func TestSeccompFilter(t *testing.T) {
+	filter, err := seccompFilter("unconfined", nil)
+	require.NoError(t, err)
+	require.Nil(t, filter)
+
+	filter, err = seccompFilter("", nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, filter)
+
+	_, err = seccompFilter("/nonexistent/seccomp.json", nil)
+	require.Error(t, err)
+}
+
+func TestLandlockRules(t *testing.T) {
+	binds := []mounter.Bind{
+		{HostDir: "/var/log/app", ContainerDir: "/var/log", RW: true},
+		{HostDir: "/etc/app", ContainerDir: "/etc/app"},
+	}
+	rules, err := landlockRules(binds, []string{"/tmp/"})
+	require.NoError(t, err)
+	require.Equal(t, []landlock.Rule{
+		{Path: "/"},
+		{Path: "/dev", Writable: true},
+		{Path: "/var/log", Writable: true},
+		{Path: "/tmp", Writable: true},
+	}, rules)
+
+	_, err = landlockRules(nil, []string{"tmp"})
+	require.Error(t, err)
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/manifest"
 	"github.com/asmyasnikov/droot/mounter"
 )
 
@@ -30,5 +32,12 @@ func doUmount(c *cli.Context) error {
 	}
 
 	mnt := mounter.NewMounter(rootDir)
+	// Bind mounts of the manifest are unmounted first, and the rest of mount points
+	// under the root then, so that a broken manifest never prevents umount.
+	if m, err := manifest.Load(rootDir); err != nil {
+		log.Info(err)
+	} else if err := mnt.UmountBinds(m.Binds); err != nil {
+		return err
+	}
 	return mnt.UmountRoot()
 }
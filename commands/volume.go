@@ -0,0 +1,136 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+
+	"github.com/asmyasnikov/droot/volume"
+)
+
+var CommandArgVolume = "COMMAND [arg...]"
+var CommandArgVolumeCreate = "[--label KEY=VALUE] [NAME]"
+var CommandArgVolumeLs = "[--quiet]"
+var CommandArgVolumeRm = "[--force] NAME [NAME...]"
+var CommandArgVolumeInspect = "NAME [NAME...]"
+var CommandVolume = cli.Command{
+	Name:  "volume",
+	Usage: "Manage volumes of the volume store of droot, mounted by 'run --volume'",
+	Subcommands: []cli.Command{
+		{
+			Name:   "create",
+			Usage:  "Create a volume, named randomly without NAME",
+			Action: fatalOnError(doVolumeCreate),
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "label",
+					Value: &cli.StringSlice{},
+					Usage: "Set a label KEY=VALUE of the volume (can be specifies multiple times)",
+				},
+			},
+		},
+		{
+			Name:   "ls",
+			Usage:  "List volumes",
+			Action: fatalOnError(doVolumeLs),
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "quiet, q", Usage: "Only print volume names"},
+			},
+		},
+		{
+			Name:   "rm",
+			Usage:  "Remove volumes and their data",
+			Action: fatalOnError(doVolumeRm),
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "force, f", Usage: "Remove volumes even if they are mounted"},
+			},
+		},
+		{
+			Name:   "inspect",
+			Usage:  "Print volumes in JSON",
+			Action: fatalOnError(doVolumeInspect),
+		},
+	},
+}
+
+func doVolumeCreate(c *cli.Context) error {
+	if len(c.Args()) > 1 {
+		cli.ShowCommandHelp(c, "create")
+		return errors.New("Too many arguments")
+	}
+	var labels map[string]string
+	for _, l := range c.StringSlice("label") {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		kv := append(strings.SplitN(l, "=", 2), "")
+		labels[kv[0]] = kv[1]
+	}
+	v, err := volume.NewStore(volume.DefaultRoot).Create(c.Args().First(), labels)
+	if err != nil {
+		return err
+	}
+	fmt.Println(v.Name)
+	return nil
+}
+
+func doVolumeLs(c *cli.Context) error {
+	volumes, err := volume.NewStore(volume.DefaultRoot).List()
+	if err != nil {
+		return err
+	}
+	if c.Bool("quiet") {
+		for _, v := range volumes {
+			fmt.Println(v.Name)
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME NAME\tMOUNTPOINT")
+	for _, v := range volumes {
+		fmt.Fprintf(w, "%s\t%s\n", v.Name, v.Mountpoint)
+	}
+	return w.Flush()
+}
+
+func doVolumeRm(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		cli.ShowCommandHelp(c, "rm")
+		return errors.New("NAME required")
+	}
+	store := volume.NewStore(volume.DefaultRoot)
+	for _, name := range c.Args() {
+		if err := store.Remove(name, c.Bool("force")); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func doVolumeInspect(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		cli.ShowCommandHelp(c, "inspect")
+		return errors.New("NAME required")
+	}
+	store := volume.NewStore(volume.DefaultRoot)
+	volumes := []*volume.Volume{}
+	for _, name := range c.Args() {
+		v, err := store.Get(name)
+		if err != nil {
+			return err
+		}
+		volumes = append(volumes, v)
+	}
+	b, err := json.MarshalIndent(volumes, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
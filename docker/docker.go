@@ -4,6 +4,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/manifest"
 	"github.com/asmyasnikov/droot/mounter"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -14,13 +15,16 @@ import (
 	"golang.org/x/net/context" // docker/docker don't use 'context' as standard package.
 	"io"
 	"strings"
+	"time"
 )
 
 // dockerAPI is an interface for stub testing.
 type dockerAPI interface {
 	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
 	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
 	ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error
 	ContainerWait(ctx context.Context, containerID string) (int64, error)
 	ContainerExport(ctx context.Context, containerID string) (io.ReadCloser, error)
 	ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
@@ -28,7 +32,7 @@ type dockerAPI interface {
 
 // Client represents a Docker API client.
 type Client struct {
-	docker *client.Client
+	docker dockerAPI
 }
 
 // New creates the Client instance.
@@ -43,11 +47,15 @@ func New() (*Client, error) {
 	return &Client{docker: cli}, nil
 }
 
-func (c *Client) Inspect(ctx context.Context, id string) (info *types.ContainerJSON, needStop bool, needRemove bool, err error) {
+// Inspect returns the container to export for id, which names either an existing container or an image.
+// An existing container is started only if start is true and it is not running yet.
+// An image is never started: a container is created from it and left stopped, and its
+// entrypoint, cmd, env, user and working directory are taken from the image itself.
+func (c *Client) Inspect(ctx context.Context, id string, start bool) (info *types.ContainerJSON, needStop bool, needRemove bool, err error) {
 	// check first existing container
 	inspect, err := c.docker.ContainerInspect(ctx, id)
 	if err == nil {
-		if inspect.State.Running {
+		if !start || inspect.State.Running {
 			return &inspect, false, false, nil
 		}
 		if err := c.docker.ContainerStart(ctx, inspect.ID, types.ContainerStartOptions{}); err != nil {
@@ -55,15 +63,30 @@ func (c *Client) Inspect(ctx context.Context, id string) (info *types.ContainerJ
 		}
 		return &inspect, true, false, nil
 	}
-	container, err := c.docker.ContainerCreate(ctx, &container.Config{
-		Image:      id,
-		User:       "root",       // Avoid permission denied error
+	image, _, err := c.docker.ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		return nil, false, false, errors.Wrapf(err, "No such container or image %s", id)
+	}
+	created, err := c.docker.ContainerCreate(ctx, &container.Config{
+		Image: id,
 	}, nil, nil, "")
 	if err != nil {
-		return nil, false, true, errors.Wrapf(err, "Failed to create container from image %s", id)
+		return nil, false, false, errors.Wrapf(err, "Failed to create container from image %s", id)
+	}
+	inspect, err = c.docker.ContainerInspect(ctx, created.ID)
+	if err != nil {
+		return &types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{ID: created.ID},
+		}, false, true, errors.Wrapf(err, "Failed to inspect container %s", created.ID)
 	}
-	info, needStop, _, err = c.Inspect(ctx, container.ID)
-	return info, needStop, true, err
+	if image.Config != nil {
+		inspect.Config.Entrypoint = image.Config.Entrypoint
+		inspect.Config.Cmd = image.Config.Cmd
+		inspect.Config.Env = image.Config.Env
+		inspect.Config.User = image.Config.User
+		inspect.Config.WorkingDir = image.Config.WorkingDir
+	}
+	return &inspect, false, true, nil
 }
 
 func (c *Client) Stop(ctx context.Context, containerID string) (error) {
@@ -93,21 +116,22 @@ func (c *Client) writeFakeFile(w *tar.Writer, path string, body []byte, mode int
 			Typeflag: tar.TypeReg,
 			Size:     int64(len(body)),
 		},
-		body,
+		bytes.NewReader(body),
 	)
 }
 
-func (c *Client) write(w *tar.Writer, h *tar.Header, b []byte) (error) {
+// write copies an entry body from r straight into w, so that memory usage
+// does not depend on the size of the entry.
+func (c *Client) write(w *tar.Writer, h *tar.Header, r io.Reader) (error) {
 	if err := w.WriteHeader(h); err != nil {
 		return err
 	}
-	if _, err := w.Write(b); err != nil {
+	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
 	return nil
 }
 
-
 // ExportImage exports a docker image into the archive of filesystem.
 func (c *Client) Export(ctx context.Context, containerID string, info *types.ContainerJSON) (io.ReadCloser, error) {
 	reader, writer := io.Pipe()
@@ -153,13 +177,22 @@ func (c *Client) Export(ctx context.Context, containerID string, info *types.Con
 			writer.CloseWithError(errors.Wrapf(err, "Failed to write binds"))
 			return
 		}
+		config, err := manifest.FromContainer(info).Marshal()
+		if err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to encode manifest"))
+			return
+		}
+		if err := c.writeFakeFile(w, manifest.DROOT_MANIFEST_FILE_PATH, config, 0644); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to write manifest"))
+			return
+		}
 		body, err := c.docker.ContainerExport(ctx, containerID)
 		if err != nil {
 			writer.CloseWithError(errors.Wrapf(err, "Failed to export container %s", containerID))
 			return
 		}
+		defer body.Close()
 		r := tar.NewReader(body)
-		buffer := new(bytes.Buffer)
 		for {
 			h, err := r.Next()
 			if err  == io.EOF {
@@ -169,14 +202,15 @@ func (c *Client) Export(ctx context.Context, containerID string, info *types.Con
 				writer.CloseWithError(errors.Wrapf(err, "Failed to read contents of container %s after export", containerID))
 				return
 			}
-			buffer.Reset()
-			buffer.ReadFrom(r)
-			if err := c.write(w, h, buffer.Bytes()); err != nil {
+			if err := c.write(w, h, r); err != nil {
 				writer.CloseWithError(errors.Wrapf(err, "Failed to copy %s from container %s", h.Name, containerID))
 				return
 			}
 		}
-		w.Close()
+		if err := w.Close(); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to finish archive of container %s", containerID))
+			return
+		}
 		writer.Close()
 	}()
 	return reader, nil
@@ -1,62 +1,255 @@
 package docker
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
 	"io"
 	"io/ioutil"
-	"strings"
+	"runtime"
 	"testing"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"golang.org/x/net/context" // docker/docker don't use 'context' as standard package.
+
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/manifest"
+	"github.com/asmyasnikov/droot/mounter"
 )
 
-func TestExportImage(t *testing.T) {
+func newFakeDocker(started *[]string) *fakeDocker {
 	containerID := "container ID"
-
-	fakeClient := &fakeDocker{
+	return &fakeDocker{
 		FakeImageInspectWithRaw: func(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
 			return types.ImageInspect{
-				ContainerConfig: &container.Config{
-					Env: []string{"PATH=/usr/bin:/sbin:/bin"},
+				ID: "sha256:aaaaaaaaaaaa",
+				Config: &container.Config{
+					Entrypoint: []string{"/docker-entrypoint.sh"},
+					Cmd:        []string{"app", "serve"},
+					Env:        []string{"PATH=/usr/bin:/sbin:/bin"},
+					User:       "app",
+					WorkingDir: "/srv/app",
 				},
 			}, []byte{}, nil
 		},
+		FakeContainerInspect: func(ctx context.Context, id string) (types.ContainerJSON, error) {
+			switch id {
+			case containerID:
+				return types.ContainerJSON{
+					ContainerJSONBase: &types.ContainerJSONBase{
+						ID:    containerID,
+						Image: "sha256:aaaaaaaaaaaa",
+						State: &types.ContainerState{},
+					},
+					Config: &container.Config{},
+				}, nil
+			case "stopped":
+				return types.ContainerJSON{
+					ContainerJSONBase: &types.ContainerJSONBase{
+						ID:    "stopped",
+						State: &types.ContainerState{Running: false},
+					},
+					Config: &container.Config{},
+				}, nil
+			}
+			return types.ContainerJSON{}, errors.New("no such container")
+		},
 		FakeContainerCreate: func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
 			return container.ContainerCreateCreatedBody{ID: containerID}, nil
 		},
 		FakeContainerStart: func(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+			*started = append(*started, containerID)
 			return nil
 		},
-		FakeContainerWait: func(ctx context.Context, containerID string) (int64, error) {
-			return int64(0), nil
-		},
 		FakeContainerExport: func(ctx context.Context, containerID string) (io.ReadCloser, error) {
-			return ioutil.NopCloser(strings.NewReader("image body")), nil
+			buf := new(bytes.Buffer)
+			w := tar.NewWriter(buf)
+			body := []byte("image body")
+			w.WriteHeader(&tar.Header{Name: "app", Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(body))})
+			w.Write(body)
+			w.Close()
+			return ioutil.NopCloser(buf), nil
 		},
 		FakeContainerRemove: func(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
 			return nil
 		},
 	}
+}
 
-	client := &Client{docker: fakeClient}
-	r, err := client.ExportImage("aaaaaaaaaaaa")
+func TestInspectImage(t *testing.T) {
+	var started []string
+	client := &Client{docker: newFakeDocker(&started)}
+
+	info, needStop, needRemove, err := client.Inspect(context.Background(), "aaaaaaaaaaaa", true)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(started) > 0 {
+		t.Errorf("should not start container created from image: started %v", started)
+	}
+	if needStop {
+		t.Error("should not need to stop container created from image")
+	}
+	if !needRemove {
+		t.Error("should need to remove container created from image")
+	}
+	if got, want := info.Config.User, "app"; got != want {
+		t.Errorf("should take user from image: got %v, want %v", got, want)
+	}
+	if got, want := info.Config.WorkingDir, "/srv/app"; got != want {
+		t.Errorf("should take working directory from image: got %v, want %v", got, want)
+	}
+	if len(info.Config.Entrypoint) != 1 || len(info.Config.Cmd) != 2 || len(info.Config.Env) != 1 {
+		t.Errorf("should take entrypoint, cmd and env from image: got %+v", info.Config)
+	}
+}
+
+func TestInspectContainer(t *testing.T) {
+	var started []string
+	client := &Client{docker: newFakeDocker(&started)}
+
+	_, needStop, needRemove, err := client.Inspect(context.Background(), "stopped", false)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(started) > 0 || needStop || needRemove {
+		t.Errorf("should not start existing container unless asked: started %v", started)
+	}
+
+	_, needStop, needRemove, err = client.Inspect(context.Background(), "stopped", true)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(started) != 1 || !needStop || needRemove {
+		t.Errorf("should start existing container when asked: started %v", started)
+	}
+}
+
+func TestExportImage(t *testing.T) {
+	var started []string
+	client := &Client{docker: newFakeDocker(&started)}
+
+	ctx := context.Background()
+	info, _, _, err := client.Inspect(ctx, "aaaaaaaaaaaa", false)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	r, err := client.Export(ctx, info.ID, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
 	defer r.Close()
 
-	time.Sleep(10 * time.Millisecond) // wait for finishing goroutine
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		files[h.Name] = string(b)
+	}
+	if got, want := files["app"], "image body"; got != want {
+		t.Errorf("should read image: got %v, want %v", got, want)
+	}
+	if got, want := files[environ.DROOT_ENV_FILE_PATH], "PATH=/usr/bin:/sbin:/bin\n\n"; got != want {
+		t.Errorf("should write envs: got %q, want %q", got, want)
+	}
+	if _, ok := files[mounter.DROOT_BINDS_FILE_PATH]; !ok {
+		t.Errorf("should write binds")
+	}
+	m, err := manifest.Parse([]byte(files[manifest.DROOT_MANIFEST_FILE_PATH]))
+	if err != nil {
+		t.Fatalf("should write manifest: %v", err)
+	}
+	if m.ImageID != "sha256:aaaaaaaaaaaa" || len(m.Entrypoint) != 1 || len(m.Cmd) != 2 {
+		t.Errorf("should write image config into manifest: got %+v", m)
+	}
+}
 
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestExportLargeEntry(t *testing.T) {
+	const (
+		entrySize    = 256 << 20 // larger than the budget below
+		memoryBudget = 32 << 20
+	)
+
+	var started []string
+	fakeClient := newFakeDocker(&started)
+	fakeClient.FakeContainerExport = func(ctx context.Context, containerID string) (io.ReadCloser, error) {
+		r, w := io.Pipe()
+		go func() {
+			tw := tar.NewWriter(w)
+			if err := tw.WriteHeader(&tar.Header{Name: "weights.bin", Mode: 0644, Typeflag: tar.TypeReg, Size: entrySize}); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, io.LimitReader(zeroReader{}, entrySize)); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			w.CloseWithError(tw.Close())
+		}()
+		return r, nil
+	}
+	client := &Client{docker: fakeClient}
+
+	ctx := context.Background()
+	info, _, _, err := client.Inspect(ctx, "aaaaaaaaaaaa", false)
 	if err != nil {
-		t.Errorf("should not be error: %v", err)
+		t.Fatalf("should not be error: %v", err)
 	}
 
-	b := make([]byte, 10)
-	_, err = r.Read(b)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	r, err := client.Export(ctx, info.ID, info)
 	if err != nil {
-		panic(err)
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	var size int64
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		n, err := io.Copy(ioutil.Discard, tr)
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if h.Name == "weights.bin" {
+			size = n
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+	if size != entrySize {
+		t.Errorf("should export the whole entry: got %d bytes, want %d", size, entrySize)
 	}
-	if string(b) != "image body" {
-		t.Errorf("should read image: got %v, want %v", string(b), "image body")
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > memoryBudget {
+		t.Errorf("should stream entries: allocated %d bytes, budget %d", allocated, memoryBudget)
 	}
 }
@@ -2,6 +2,7 @@ package docker
 
 import (
 	"io"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
@@ -12,8 +13,10 @@ import (
 type fakeDocker struct {
 	dockerAPI
 	FakeImageInspectWithRaw func(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	FakeContainerInspect    func(ctx context.Context, containerID string) (types.ContainerJSON, error)
 	FakeContainerCreate     func(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error)
 	FakeContainerStart      func(ctx context.Context, containerID string, options types.ContainerStartOptions) error
+	FakeContainerStop       func(ctx context.Context, containerID string, timeout *time.Duration) error
 	FakeContainerWait       func(ctx context.Context, containerID string) (int64, error)
 	FakeContainerExport     func(ctx context.Context, containerID string) (io.ReadCloser, error)
 	FakeContainerRemove     func(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error
@@ -23,6 +26,10 @@ func (d *fakeDocker) ImageInspectWithRaw(ctx context.Context, imageID string) (t
 	return d.FakeImageInspectWithRaw(ctx, imageID)
 }
 
+func (d *fakeDocker) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	return d.FakeContainerInspect(ctx, containerID)
+}
+
 func (d *fakeDocker) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
 	return d.FakeContainerRemove(ctx, containerID, options)
 }
@@ -35,6 +42,10 @@ func (d *fakeDocker) ContainerStart(ctx context.Context, containerID string, opt
 	return d.FakeContainerStart(ctx, containerID, options)
 }
 
+func (d *fakeDocker) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	return d.FakeContainerStop(ctx, containerID, timeout)
+}
+
 func (d *fakeDocker) ContainerWait(ctx context.Context, containerID string) (int64, error) {
 	return d.FakeContainerWait(ctx, containerID)
 }
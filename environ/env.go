@@ -50,6 +50,26 @@ func containerEnvs(path string) (map[string]string, error) {
 	return env, nil
 }
 
+// ReadEnvFile reads the environment variables of DROOT_ENV_FILE_PATH in their order.
+func ReadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l := strings.Trim(scanner.Text(), " \n\t")
+		if _, _, err := parseEnv(l); err != nil {
+			continue
+		}
+		env = append(env, l)
+	}
+	return env, scanner.Err()
+}
+
 func Environ(e []string, path string) (env []string, err error) {
 	kv, err := containerEnvs(path)
 	if err != nil {
@@ -67,3 +87,23 @@ func Environ(e []string, path string) (env []string, err error) {
 	}
 	return env, nil
 }
+
+// Override sets the variables of overrides in env, keeping the order of env
+// and appending the variables which are not set yet.
+func Override(env []string, overrides []string) ([]string, error) {
+	index := make(map[string]int)
+	result := make([]string, 0, len(env)+len(overrides))
+	for _, l := range append(env, overrides...) {
+		k, _, err := parseEnv(l)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[k]; ok {
+			result[i] = l
+			continue
+		}
+		index[k] = len(result)
+		result = append(result, l)
+	}
+	return result, nil
+}
@@ -51,3 +51,21 @@ func TestEnviron(t *testing.T) {
 		t.Fatalf("diff: (-actual +expected)\n%s", diff)
 	}
 }
+
+func TestOverride(t *testing.T) {
+	env, err := Override(
+		[]string{"PATH=/usr/bin:/bin", "HOME=/root", "LANG=C"},
+		[]string{"HOME=/home/app", "TZ=UTC"},
+	)
+	if err != nil {
+		t.Errorf("should not be error: %v", err)
+	}
+	expected := []string{"PATH=/usr/bin:/bin", "HOME=/home/app", "LANG=C", "TZ=UTC"}
+	if diff := pretty.Compare(env, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	if _, err := Override(nil, []string{"INVALID"}); err == nil {
+		t.Error("should be error")
+	}
+}
@@ -0,0 +1,227 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const dockerArchiveManifest = "manifest.json"
+
+// dockerArchive is an image in an archive created by `docker save`.
+type dockerArchive struct {
+	file    *os.File
+	entries map[string]*io.SectionReader
+	config  string
+	layers  []string
+}
+
+// archiveLayer is a layer stored as a file inside a `docker save` archive.
+type archiveLayer struct {
+	r *io.SectionReader
+}
+
+// rootfsArchive is a flat root filesystem archive created by `docker export`.
+type rootfsArchive struct {
+	path string
+}
+
+// splitFile splits a reference of the form FILE[:SUFFIX] at the first colon
+// where the part before it names an existing file, as FILE may itself contain colons.
+func splitFile(ref string) (string, string) {
+	for i := 0; i < len(ref); i++ {
+		if ref[i] != ':' {
+			continue
+		}
+		if info, err := os.Stat(ref[:i]); err == nil && info.Mode().IsRegular() {
+			return ref[:i], ref[i+1:]
+		}
+	}
+	return ref, ""
+}
+
+// openDockerArchive opens the image tagged tag in a `docker save` archive at ref, given as FILE[:REPO:TAG].
+func openDockerArchive(ref string) (Source, error) {
+	file, tag := splitFile(ref)
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &dockerArchive{file: f, entries: map[string]*io.SectionReader{}}
+	if err := a.index(); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "Failed to read %s", file)
+	}
+	if err := a.findTag(tag); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "Failed to find image in %s", file)
+	}
+	return a, nil
+}
+
+// index records where each file of the archive is, so that files can be read in any order.
+func (a *dockerArchive) index() error {
+	// Links are resolved once all the files are indexed, since `docker save` stores
+	// a layer repeated in the image as a symbolic link to the earlier identical one.
+	links := map[string]string{}
+	r := tar.NewReader(a.file)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			links[clean(h.Name)] = clean(path.Join(path.Dir(clean(h.Name)), h.Linkname))
+			continue
+		case tar.TypeLink:
+			links[clean(h.Name)] = clean(h.Linkname)
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			continue
+		}
+		// The reader seeks over file contents, so the file offset is where the contents begin.
+		offset, err := a.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		a.entries[clean(h.Name)] = io.NewSectionReader(a.file, offset, h.Size)
+	}
+	for name, target := range links {
+		// A link to a link is followed, up to as many links as the archive has, which breaks loops.
+		for i := 0; i < len(links); i++ {
+			next, ok := links[target]
+			if !ok {
+				break
+			}
+			target = next
+		}
+		if r, ok := a.entries[target]; ok {
+			a.entries[name] = r
+		}
+	}
+	return nil
+}
+
+func (a *dockerArchive) findTag(tag string) error {
+	var manifests []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := a.readJSON(dockerArchiveManifest, &manifests); err != nil {
+		return err
+	}
+	if tag != "" && !strings.Contains(path.Base(tag), ":") {
+		tag += ":latest"
+	}
+	for _, m := range manifests {
+		found := tag == "" && len(manifests) == 1
+		for _, t := range m.RepoTags {
+			found = found || t == tag
+		}
+		if found {
+			a.config, a.layers = m.Config, m.Layers
+			return nil
+		}
+	}
+	if tag == "" {
+		return errors.New("Archive contains several images, a tag is required")
+	}
+	return errors.Errorf("No image tagged %s", tag)
+}
+
+func (a *dockerArchive) entry(name string) (*io.SectionReader, error) {
+	r, ok := a.entries[clean(name)]
+	if !ok {
+		return nil, errors.Errorf("No such file %s in archive", name)
+	}
+	return io.NewSectionReader(r, 0, r.Size()), nil
+}
+
+func (a *dockerArchive) readJSON(name string, v interface{}) error {
+	r, err := a.entry(name)
+	if err != nil {
+		return err
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		return errors.Wrapf(err, "Failed to decode %s", name)
+	}
+	return nil
+}
+
+func (a *dockerArchive) ID() string {
+	// The config is named after its digest, e.g. <hex>.json or blobs/sha256/<hex>.
+	hex := strings.TrimSuffix(path.Base(a.config), ".json")
+	if len(hex) != sha256.Size*2 {
+		return ""
+	}
+	return "sha256:" + hex
+}
+
+func (a *dockerArchive) Config() (*Config, error) {
+	var cfg Config
+	if err := a.readJSON(a.config, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (a *dockerArchive) Layers() ([]Layer, error) {
+	layers := make([]Layer, 0, len(a.layers))
+	for _, name := range a.layers {
+		r, err := a.entry(name)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, &archiveLayer{r: r})
+	}
+	return layers, nil
+}
+
+func (a *dockerArchive) Close() error {
+	return a.file.Close()
+}
+
+func (l *archiveLayer) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.NewSectionReader(l.r, 0, l.r.Size())), nil
+}
+
+// openRootfsArchive opens a flat root filesystem archive, which has no image config.
+func openRootfsArchive(ref string) (Source, error) {
+	if _, err := os.Stat(ref); err != nil {
+		return nil, err
+	}
+	return &rootfsArchive{path: ref}, nil
+}
+
+func (a *rootfsArchive) ID() string {
+	return ""
+}
+
+func (a *rootfsArchive) Config() (*Config, error) {
+	return &Config{}, nil
+}
+
+func (a *rootfsArchive) Layers() ([]Layer, error) {
+	return []Layer{a}, nil
+}
+
+func (a *rootfsArchive) Open() (io.ReadCloser, error) {
+	return os.Open(a.path)
+}
+
+func (a *rootfsArchive) Close() error {
+	return nil
+}
@@ -0,0 +1,185 @@
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asmyasnikov/droot/environ"
+)
+
+func writeArchive(t *testing.T, files map[string][]byte) string {
+	f, err := ioutil.TempFile("", "droot_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := tar.NewWriter(f)
+	for name, body := range files {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(body))})
+		w.Write(body)
+	}
+	w.Close()
+	return f.Name()
+}
+
+func makeDockerArchive(t *testing.T) string {
+	manifest, _ := json.Marshal([]map[string]interface{}{
+		{
+			"Config":   "config.json",
+			"RepoTags": []string{"example/app:v1"},
+			"Layers":   []string{"lower/layer.tar", "upper/layer.tar"},
+		},
+		{
+			"Config":   "config.json",
+			"RepoTags": []string{"example/app:latest"},
+			"Layers":   []string{"lower/layer.tar"},
+		},
+	})
+	config, _ := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{"Env": []string{"LANG=C"}},
+	})
+	return writeArchive(t, map[string][]byte{
+		"manifest.json": manifest,
+		"config.json":   config,
+		"lower/layer.tar": makeLayer(
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"},
+			testEntry{name: "etc/issue", typeflag: tar.TypeReg, body: "v0"},
+		),
+		"upper/layer.tar": gzipped(makeLayer(
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/.wh..wh..opq", typeflag: tar.TypeReg},
+			testEntry{name: "etc/issue", typeflag: tar.TypeReg, body: "v1"},
+		)),
+	})
+}
+
+func TestExportDockerArchive(t *testing.T) {
+	file := makeDockerArchive(t)
+	defer os.Remove(file)
+
+	for ref, expected := range map[string]map[string]string{
+		"docker-archive:" + file + ":example/app:v1": {
+			environ.DROOT_ENV_FILE_PATH: "LANG=C\n\n",
+			"etc/":                      "",
+			"etc/issue":                 "v1",
+		},
+		"docker-archive:" + file + ":example/app": {
+			"etc/":      "",
+			"etc/motd":  "hello",
+			"etc/issue": "v0",
+		},
+	} {
+		src, err := Open(ref)
+		if err != nil {
+			t.Fatalf("%s should not be error: %v", ref, err)
+		}
+		info, err := Inspect(src, ref)
+		if err != nil {
+			t.Fatalf("%s should not be error: %v", ref, err)
+		}
+		r, err := Export(src, info)
+		if err != nil {
+			t.Fatalf("%s should not be error: %v", ref, err)
+		}
+		files := readArchive(t, r)
+		r.Close()
+		src.Close()
+		for name, body := range expected {
+			if got, ok := files[name]; !ok || got != body {
+				t.Errorf("%s: %s should be %q: got %q", ref, name, body, got)
+			}
+		}
+		if _, ok := files["etc/motd"]; ok && expected["etc/motd"] == "" {
+			t.Errorf("%s: should apply opaque directories", ref)
+		}
+	}
+
+	if _, err := Open("docker-archive:" + file); err == nil {
+		t.Error("should be error without tag for several images")
+	}
+}
+
+func TestExportDockerArchiveLinkedLayer(t *testing.T) {
+	// `docker save` stores a repeated layer as a link to the earlier identical one.
+	manifest, _ := json.Marshal([]map[string]interface{}{
+		{
+			"Config":   "config.json",
+			"RepoTags": []string{"example/app:latest"},
+			"Layers":   []string{"lower/layer.tar", "middle/layer.tar", "upper/layer.tar", "top/layer.tar"},
+		},
+	})
+	f, err := ioutil.TempFile("", "droot_archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w := tar.NewWriter(f)
+	for _, e := range []testEntry{
+		{name: "manifest.json", typeflag: tar.TypeReg, body: string(manifest)},
+		{name: "config.json", typeflag: tar.TypeReg, body: "{}"},
+		{name: "lower/layer.tar", typeflag: tar.TypeReg, body: string(makeLayer(
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/motd", typeflag: tar.TypeReg, body: "hello"},
+		))},
+		{name: "middle/layer.tar", typeflag: tar.TypeReg, body: string(makeLayer(
+			testEntry{name: "etc/motd", typeflag: tar.TypeReg, body: "bye"},
+		))},
+		{name: "upper/layer.tar", typeflag: tar.TypeSymlink, linkname: "../lower/layer.tar"},
+		{name: "top/layer.tar", typeflag: tar.TypeLink, linkname: "upper/layer.tar"},
+	} {
+		w.WriteHeader(&tar.Header{Name: e.name, Mode: 0644, Typeflag: e.typeflag, Linkname: e.linkname, Size: int64(len(e.body))})
+		w.Write([]byte(e.body))
+	}
+	w.Close()
+	f.Close()
+
+	ref := "docker-archive:" + f.Name()
+	src, err := Open(ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	r, err := Export(src, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	if got := readArchive(t, r)["etc/motd"]; got != "hello" {
+		t.Errorf("etc/motd should be %q of the linked layer: got %q", "hello", got)
+	}
+}
+
+func TestExportRootfsArchive(t *testing.T) {
+	file := writeArchive(t, map[string][]byte{"bin/sh": []byte("shell")})
+	defer os.Remove(file)
+
+	src, err := Open("rootfs:" + file)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, "rootfs:"+file)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	r, err := Export(src, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	files := readArchive(t, r)
+	if got, want := files["bin/sh"], "shell"; got != want {
+		t.Errorf("should export rootfs: got %q, want %q", got, want)
+	}
+	if got, want := files[environ.DROOT_ENV_FILE_PATH], "\n\n"; got != want {
+		t.Errorf("should write empty envs: got %q, want %q", got, want)
+	}
+}
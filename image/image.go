@@ -0,0 +1,318 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/manifest"
+	"github.com/asmyasnikov/droot/mounter"
+)
+
+// Media types of the manifests and indexes droot understands.
+const (
+	MediaTypeOCIIndex         = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest      = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeDockerList       = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest   = "application/vnd.docker.distribution.manifest.v2+json"
+	annotationRefName         = "org.opencontainers.image.ref.name"
+	annotationContainerdImage = "io.containerd.image.name"
+)
+
+// Descriptor describes a blob of an image by its digest.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Platform describes the platform an image in an index is built for.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Index is an OCI image index or a Docker manifest list.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Manifest is an OCI image manifest or a Docker v2 schema 2 manifest.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// Config is the image configuration shared by OCI and Docker images.
+type Config struct {
+	Architecture string           `json:"architecture"`
+	OS           string           `json:"os"`
+	Config       container.Config `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// Layer is a filesystem layer of an image.
+type Layer interface {
+	// Open returns the layer archive, which may be compressed.
+	Open() (io.ReadCloser, error)
+}
+
+// Source is an image which is read without a Docker daemon.
+type Source interface {
+	// ID returns the digest of the image configuration, which Docker uses as the image ID,
+	// or an empty string if the image has no configuration.
+	ID() string
+	// Config returns the image configuration.
+	Config() (*Config, error)
+	// Layers returns the layers of the image from the lowest to the topmost.
+	Layers() ([]Layer, error)
+	// Close releases resources held by the source.
+	Close() error
+}
+
+var transports = map[string]func(string) (Source, error){
+	"oci:":            openOCI,
+	"docker-archive:": openDockerArchive,
+	"rootfs:":         openRootfsArchive,
+	"registry://":     openRegistry,
+}
+
+// IsReference reports whether ref names an image read without a Docker daemon,
+// e.g. oci:/path/to/layout:tag, docker-archive:/file.tar:repo:tag, rootfs:/file.tar
+// or registry://host/repo:tag.
+func IsReference(ref string) bool {
+	for prefix := range transports {
+		if strings.HasPrefix(ref, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open opens the image named by ref.
+func Open(ref string) (Source, error) {
+	for prefix, open := range transports {
+		if strings.HasPrefix(ref, prefix) {
+			return open(strings.TrimPrefix(ref, prefix))
+		}
+	}
+	return nil, errors.Errorf("Unknown image reference %s", ref)
+}
+
+// Inspect returns the image configuration of src in the form `docker inspect` reports a container,
+// so that it can be used in place of a Docker container.
+func Inspect(src Source, ref string) (*types.ContainerJSON, error) {
+	cfg, err := src.Config()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read image config of %s", ref)
+	}
+	config := cfg.Config
+	config.Image = ref
+	id := src.ID()
+	if id == "" {
+		id = ref
+	}
+	return &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			Image:      id,
+			State:      &types.ContainerState{},
+			HostConfig: &container.HostConfig{},
+		},
+		Config:          &config,
+		NetworkSettings: &types.NetworkSettings{},
+	}, nil
+}
+
+// Export flattens the layers of src into an archive of filesystem,
+// in the same format as docker.Client.Export does.
+func Export(src Source, info *types.ContainerJSON) (io.ReadCloser, error) {
+	layers, err := src.Layers()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read layers of %s", info.Config.Image)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		w := tar.NewWriter(writer)
+		f := newFlattener()
+		if err := writeFile(w, environ.DROOT_ENV_FILE_PATH, []byte(strings.Join(info.Config.Env, "\n")+"\n\n")); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to write envs"))
+			return
+		}
+		f.skip(environ.DROOT_ENV_FILE_PATH)
+		if err := writeFile(w, mounter.DROOT_BINDS_FILE_PATH, []byte("\n\n")); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to write binds"))
+			return
+		}
+		f.skip(mounter.DROOT_BINDS_FILE_PATH)
+		b, err := manifest.FromContainer(info).Marshal()
+		if err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to encode manifest"))
+			return
+		}
+		if err := writeFile(w, manifest.DROOT_MANIFEST_FILE_PATH, b); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to write manifest"))
+			return
+		}
+		f.skip(path.Dir(manifest.DROOT_MANIFEST_FILE_PATH))
+		if err := f.flatten(w, layers); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to flatten layers of %s", info.Config.Image))
+			return
+		}
+		if err := w.Close(); err != nil {
+			writer.CloseWithError(errors.Wrapf(err, "Failed to finish archive of %s", info.Config.Image))
+			return
+		}
+		writer.Close()
+	}()
+	return reader, nil
+}
+
+func writeFile(w *tar.Writer, path string, body []byte) error {
+	if err := w.WriteHeader(&tar.Header{
+		Uname:    "root",
+		Gname:    "root",
+		Mode:     0644,
+		Name:     path,
+		Typeflag: tar.TypeReg,
+		Size:     int64(len(body)),
+	}); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// selectManifest picks the manifest built for the host platform out of an index.
+func selectManifest(manifests []Descriptor) (Descriptor, error) {
+	return selectPlatform(manifests, runtime.GOOS, runtime.GOARCH, hostVariants())
+}
+
+// selectPlatform picks the manifest built for os and arch out of an index, preferring
+// variants in order. Any variant is picked if variants is empty.
+func selectPlatform(manifests []Descriptor, os, arch string, variants []string) (Descriptor, error) {
+	matches := func(d Descriptor) bool {
+		return d.Platform != nil && d.Platform.OS == os && d.Platform.Architecture == arch
+	}
+	if len(variants) == 0 {
+		for _, d := range manifests {
+			if matches(d) {
+				return d, nil
+			}
+		}
+	}
+	for _, v := range variants {
+		for _, d := range manifests {
+			if matches(d) && d.Platform.Variant == v {
+				return d, nil
+			}
+		}
+	}
+	if len(manifests) == 1 && manifests[0].Platform == nil {
+		return manifests[0], nil
+	}
+	return Descriptor{}, errors.Errorf("No image for platform %s/%s%s", os, arch, func() string {
+		if len(variants) > 0 && variants[0] != "" {
+			return "/" + variants[0]
+		}
+		return ""
+	}())
+}
+
+// hostVariants returns the variants of the host architecture which the host runs,
+// from the preferred one, or nil if they are unknown.
+func hostVariants() []string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return []string{"", "v1"}
+	case "arm64":
+		return []string{"v8", ""}
+	case "arm":
+		// An ARMv7 host runs ARMv6 and ARMv5 images too.
+		version := armVersion()
+		if version == 0 {
+			return nil
+		}
+		variants := []string{}
+		for v := version; v >= 5; v-- {
+			variants = append(variants, "v"+strconv.Itoa(v))
+		}
+		return append(variants, "")
+	}
+	return nil
+}
+
+// armVersion returns the version of the ARM architecture of the host CPU, or 0 if it is unknown.
+func armVersion() int {
+	b, err := ioutil.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "CPU architecture" {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		end := 0
+		for end < len(value) && value[end] >= '0' && value[end] <= '9' {
+			end++
+		}
+		if v, err := strconv.Atoi(value[:end]); err == nil {
+			return v
+		}
+		return 0
+	}
+	return 0
+}
+
+// isIndex reports whether the media type is an OCI index or a Docker manifest list.
+func isIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerList
+}
+
+// verifier checks the digest of the content read through it once it reaches EOF.
+type verifier struct {
+	r      io.Reader
+	hash   hash.Hash
+	digest string
+}
+
+func newVerifier(r io.Reader, digest string) (io.Reader, error) {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil, errors.Errorf("Unsupported digest %s", digest)
+	}
+	return &verifier{r: r, hash: sha256.New(), digest: digest}, nil
+}
+
+func (v *verifier) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.hash.Write(b[:n])
+	if err == io.EOF {
+		if actual := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); actual != v.digest {
+			return n, errors.Errorf("Digest mismatch: expected %s, got %s", v.digest, actual)
+		}
+	}
+	return n, err
+}
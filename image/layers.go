@@ -0,0 +1,231 @@
+package image
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/archive"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// flattener merges image layers into a single archive.
+//
+// Layers are read from the topmost to the lowest, so that an entry is written
+// only if no upper layer has replaced or deleted it. That way entry bodies
+// are streamed as they are, and only the paths are kept in memory.
+//
+// A hard link keeps the contents its target had in the layer of the link, even if
+// an upper layer has replaced or deleted the target. In that case the contents are
+// written under the name of the link, and other links to the target link to it.
+type flattener struct {
+	seen    map[string]bool          // paths written by upper layers, true for directories
+	hidden  map[string]bool          // paths deleted by whiteouts of upper layers
+	opaque  map[string]bool          // directories whose lower contents are hidden by upper layers
+	pending map[string][]*tar.Header // unresolved hard links by their targets
+	links   []*tar.Header            // hard links to files written
+}
+
+func newFlattener() *flattener {
+	return &flattener{
+		seen:    map[string]bool{},
+		hidden:  map[string]bool{},
+		opaque:  map[string]bool{},
+		pending: map[string][]*tar.Header{},
+	}
+}
+
+// skip hides name in all layers, e.g. because it has already been written.
+func (f *flattener) skip(name string) {
+	f.seen[clean(name)] = false
+}
+
+// clean normalizes an entry name into a relative path without trailing slash.
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// isHidden reports whether name is replaced or deleted by upper layers.
+func (f *flattener) isHidden(name string) bool {
+	if _, ok := f.seen[name]; ok || f.hidden[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if isDir, ok := f.seen[dir]; (ok && !isDir) || f.hidden[dir] || f.opaque[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *flattener) flatten(w *tar.Writer, layers []Layer) error {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := f.layer(w, layers[i]); err != nil {
+			return errors.Wrapf(err, "Failed to read layer %d", i)
+		}
+	}
+	// Hard links are written last, since their targets may come from lower layers.
+	// Links whose targets are in no layer are dropped.
+	for _, h := range f.links {
+		if err := w.WriteHeader(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// canLink reports whether a hard link may point to an entry of type typeflag.
+func canLink(typeflag byte) bool {
+	return typeflag != tar.TypeDir && typeflag != tar.TypeLink
+}
+
+// resolve writes the entry h, whose body is read from r, under the name of the
+// first of links, and makes the other links point to it.
+func (f *flattener) resolve(w *tar.Writer, h *tar.Header, r io.Reader, links []*tar.Header) error {
+	file := *h
+	file.Name = links[0].Name
+	if err := w.WriteHeader(&file); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	for _, l := range links[1:] {
+		l.Linkname = file.Name
+		f.links = append(f.links, l)
+	}
+	return nil
+}
+
+// readLayer calls entry for every entry of layer, and reads the layer up to the end,
+// so that its digest is verified.
+func readLayer(layer Layer, entry func(h *tar.Header, r io.Reader) error) error {
+	raw, err := layer.Open()
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	body, err := archive.Decompress(raw)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	r := tar.NewReader(body)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := entry(h, r); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (f *flattener) layer(w *tar.Writer, layer Layer) error {
+	seen := map[string]bool{}
+	hidden := map[string]bool{}
+	opaque := map[string]bool{}
+	skipped := map[string]bool{}         // entries of this layer hidden by upper layers
+	reread := map[string][]*tar.Header{} // hard links to skipped entries
+	err := readLayer(layer, func(h *tar.Header, r io.Reader) error {
+		name := clean(h.Name)
+		if name == "" {
+			return nil
+		}
+		dir, base := path.Split(name)
+		dir = clean(dir)
+		if base == whiteoutOpaque {
+			opaque[dir] = true
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			hidden[path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))] = true
+			return nil
+		}
+		isHidden := f.isHidden(name)
+		if links, ok := f.pending[name]; ok && canLink(h.Typeflag) {
+			delete(f.pending, name)
+			if isHidden {
+				return f.resolve(w, h, r, links)
+			}
+			f.links = append(f.links, links...)
+		}
+		if isHidden {
+			skipped[name] = true
+			return nil
+		}
+		h.Name = name
+		if h.Typeflag == tar.TypeDir {
+			h.Name += "/"
+		}
+		if h.Typeflag == tar.TypeLink {
+			h.Linkname = clean(h.Linkname)
+			if _, ok := seen[h.Linkname]; !ok {
+				if skipped[h.Linkname] {
+					reread[h.Linkname] = append(reread[h.Linkname], h)
+				} else {
+					f.pending[h.Linkname] = append(f.pending[h.Linkname], h)
+				}
+				seen[name] = false
+				return nil
+			}
+		}
+		if err := w.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		seen[name] = h.Typeflag == tar.TypeDir
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Targets replaced or deleted by upper layers were read before their links,
+	// so the layer is read again for their contents.
+	if len(reread) > 0 {
+		err := readLayer(layer, func(h *tar.Header, r io.Reader) error {
+			name := clean(h.Name)
+			if links, ok := reread[name]; ok && canLink(h.Typeflag) {
+				delete(reread, name)
+				return f.resolve(w, h, r, links)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, isDir := range seen {
+		f.seen[name] = isDir
+	}
+	for name := range hidden {
+		f.hidden[name] = true
+	}
+	for name := range opaque {
+		f.opaque[name] = true
+	}
+	return nil
+}
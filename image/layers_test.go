@@ -0,0 +1,153 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+type testEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func makeLayer(entries ...testEntry) []byte {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Typeflag: e.typeflag, Mode: 0644, Size: int64(len(e.body)), Linkname: e.linkname}
+		if e.typeflag == tar.TypeDir {
+			h.Mode = 0755
+		}
+		if e.typeflag != tar.TypeReg {
+			h.Size = 0
+		}
+		w.WriteHeader(h)
+		w.Write([]byte(e.body))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+type bytesLayer []byte
+
+func (l bytesLayer) Open() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l)), nil
+}
+
+// readArchive returns the entries of an archive as name -> body or link target.
+func readArchive(t *testing.T, r io.Reader) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if _, ok := files[h.Name]; ok {
+			t.Errorf("should not write %s twice", h.Name)
+		}
+		files[h.Name] = string(b) + h.Linkname
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	layers := []Layer{
+		bytesLayer(makeLayer(
+			testEntry{name: "etc/", typeflag: tar.TypeDir},
+			testEntry{name: "etc/passwd", typeflag: tar.TypeReg, body: "root"},
+			testEntry{name: "etc/shadow", typeflag: tar.TypeReg, body: "secret"},
+			testEntry{name: "var/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/apt", typeflag: tar.TypeReg, body: "apt"},
+			testEntry{name: "opt/", typeflag: tar.TypeDir},
+			testEntry{name: "opt/app/bin", typeflag: tar.TypeReg, body: "old"},
+			testEntry{name: "usr/bin/python3", typeflag: tar.TypeReg, body: "python"},
+		)),
+		bytesLayer(makeLayer(
+			testEntry{name: "./etc/passwd", typeflag: tar.TypeReg, body: "root\napp"},
+			testEntry{name: "etc/.wh.shadow", typeflag: tar.TypeReg},
+			testEntry{name: "var/cache/", typeflag: tar.TypeDir},
+			testEntry{name: "var/cache/.wh..wh..opq", typeflag: tar.TypeReg},
+			testEntry{name: "var/cache/new", typeflag: tar.TypeReg, body: "new"},
+			testEntry{name: "opt/app", typeflag: tar.TypeSymlink, linkname: "/srv/app"},
+			testEntry{name: "usr/bin/python", typeflag: tar.TypeLink, linkname: "usr/bin/python3"},
+		)),
+	}
+
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	if err := newFlattener().flatten(w, layers); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	w.Close()
+
+	expected := map[string]string{
+		"etc/":            "",
+		"etc/passwd":      "root\napp",
+		"var/":            "",
+		"var/cache/":      "",
+		"var/cache/new":   "new",
+		"opt/":            "",
+		"opt/app":         "/srv/app",
+		"usr/bin/python3": "python",
+		"usr/bin/python":  "usr/bin/python3",
+	}
+	if diff := pretty.Compare(readArchive(t, buf), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestFlattenHardLinksToReplacedTargets(t *testing.T) {
+	layers := []Layer{
+		bytesLayer(makeLayer(
+			testEntry{name: "usr/bin/python3", typeflag: tar.TypeReg, body: "python"},
+			testEntry{name: "usr/bin/python", typeflag: tar.TypeLink, linkname: "usr/bin/python3"},
+			testEntry{name: "bin/a", typeflag: tar.TypeReg, body: "a"},
+			testEntry{name: "bin/b", typeflag: tar.TypeLink, linkname: "bin/a"},
+			testEntry{name: "bin/c", typeflag: tar.TypeLink, linkname: "bin/a"},
+			testEntry{name: "lib/libz.so", typeflag: tar.TypeReg, body: "v1"},
+		)),
+		bytesLayer(makeLayer(
+			testEntry{name: "lib/libz.so.1", typeflag: tar.TypeLink, linkname: "lib/libz.so"},
+		)),
+		bytesLayer(makeLayer(
+			testEntry{name: "usr/bin/.wh.python3", typeflag: tar.TypeReg},
+			testEntry{name: "bin/a", typeflag: tar.TypeReg, body: "new"},
+			testEntry{name: "lib/libz.so", typeflag: tar.TypeReg, body: "v2"},
+		)),
+	}
+
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	if err := newFlattener().flatten(w, layers); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	w.Close()
+
+	// Links keep the contents of their targets in their own layers.
+	expected := map[string]string{
+		"usr/bin/python": "python",
+		"bin/a":          "new",
+		"bin/b":          "a",
+		"bin/c":          "bin/b",
+		"lib/libz.so":    "v2",
+		"lib/libz.so.1":  "v1",
+	}
+	if diff := pretty.Compare(readArchive(t, buf), expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,166 @@
+package image
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const ociLayoutVersion = "1.0.0"
+
+// ociLayout is an image in an OCI image layout directory.
+type ociLayout struct {
+	dir      string
+	manifest Manifest
+}
+
+// ociBlob is a layer stored in the blobs directory of an OCI image layout.
+type ociBlob struct {
+	dir  string
+	desc Descriptor
+}
+
+// splitTag splits a reference of the form PATH[:TAG], where PATH may itself contain colons.
+func splitTag(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i+1:], "/") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// openOCI opens the image tagged tag in the OCI image layout at ref, given as PATH[:TAG].
+func openOCI(ref string) (Source, error) {
+	dir, tag := splitTag(ref)
+	var layout struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	if err := readJSON(fp.Join(dir, "oci-layout"), &layout); err != nil {
+		return nil, errors.Wrapf(err, "%s is not an OCI image layout", dir)
+	}
+	if layout.Version != ociLayoutVersion {
+		return nil, errors.Errorf("Unsupported OCI image layout version %s", layout.Version)
+	}
+	var index Index
+	if err := readJSON(fp.Join(dir, "index.json"), &index); err != nil {
+		return nil, errors.Wrapf(err, "Failed to read index of %s", dir)
+	}
+	desc, err := findTag(index.Manifests, tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to find image in %s", dir)
+	}
+	l := &ociLayout{dir: dir}
+	for isIndex(desc.MediaType) {
+		var nested Index
+		if err := l.readBlob(desc, &nested); err != nil {
+			return nil, err
+		}
+		if desc, err = selectManifest(nested.Manifests); err != nil {
+			return nil, err
+		}
+	}
+	if err := l.readBlob(desc, &l.manifest); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// findTag finds the manifest tagged tag, or the only manifest if tag is empty.
+func findTag(manifests []Descriptor, tag string) (Descriptor, error) {
+	if tag == "" {
+		if len(manifests) == 1 {
+			return manifests[0], nil
+		}
+		tag = "latest"
+	}
+	for _, d := range manifests {
+		name := d.Annotations[annotationRefName]
+		if name == tag || strings.HasSuffix(d.Annotations[annotationContainerdImage], ":"+tag) {
+			return d, nil
+		}
+	}
+	return Descriptor{}, errors.Errorf("No image tagged %s", tag)
+}
+
+func readJSON(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+func blobPath(dir string, digest string) (string, error) {
+	d := strings.SplitN(digest, ":", 2)
+	if len(d) != 2 || d[0] == "" || d[1] == "" || strings.ContainsAny(d[1], "/.") {
+		return "", errors.Errorf("Invalid digest %s", digest)
+	}
+	return fp.Join(dir, "blobs", d[0], d[1]), nil
+}
+
+func (l *ociLayout) readBlob(desc Descriptor, v interface{}) error {
+	r, err := (&ociBlob{dir: l.dir, desc: desc}).Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read blob %s", desc.Digest)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrapf(err, "Failed to decode blob %s", desc.Digest)
+	}
+	return nil
+}
+
+func (l *ociLayout) ID() string {
+	return l.manifest.Config.Digest
+}
+
+func (l *ociLayout) Config() (*Config, error) {
+	var cfg Config
+	if err := l.readBlob(l.manifest.Config, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (l *ociLayout) Layers() ([]Layer, error) {
+	layers := make([]Layer, 0, len(l.manifest.Layers))
+	for _, desc := range l.manifest.Layers {
+		layers = append(layers, &ociBlob{dir: l.dir, desc: desc})
+	}
+	return layers, nil
+}
+
+func (l *ociLayout) Close() error {
+	return nil
+}
+
+// Open opens the blob, verifying its digest as it is read.
+func (b *ociBlob) Open() (io.ReadCloser, error) {
+	path, err := blobPath(b.dir, b.desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	v, err := newVerifier(f, b.desc.Digest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{v, f}, nil
+}
@@ -0,0 +1,165 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/manifest"
+	"github.com/asmyasnikov/droot/mounter"
+)
+
+func writeBlob(t *testing.T, dir string, b []byte) Descriptor {
+	sum := sha256.Sum256(b)
+	digest := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(fp.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, "blobs", "sha256", digest), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Descriptor{Digest: "sha256:" + digest, Size: int64(len(b))}
+}
+
+func writeJSONBlob(t *testing.T, dir string, mediaType string, v interface{}) Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := writeBlob(t, dir, b)
+	d.MediaType = mediaType
+	return d
+}
+
+func gzipped(b []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func makeOCILayout(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "droot_oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(fp.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+
+	config := writeJSONBlob(t, dir, "application/vnd.oci.image.config.v1+json", map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Env":        []string{"PATH=/usr/bin:/bin"},
+			"Entrypoint": []string{"/app"},
+			"User":       "app",
+		},
+	})
+	lower := writeBlob(t, dir, gzipped(makeLayer(
+		testEntry{name: "app", typeflag: tar.TypeReg, body: "v1"},
+		testEntry{name: "tmp/", typeflag: tar.TypeDir},
+		testEntry{name: "tmp/build.log", typeflag: tar.TypeReg, body: "log"},
+	)))
+	upper := writeBlob(t, dir, makeLayer(
+		testEntry{name: "app", typeflag: tar.TypeReg, body: "v2"},
+		testEntry{name: "tmp/.wh.build.log", typeflag: tar.TypeReg},
+	))
+	manifest := writeJSONBlob(t, dir, MediaTypeOCIManifest, Manifest{
+		SchemaVersion: 2,
+		Config:        config,
+		Layers:        []Descriptor{lower, upper},
+	})
+	manifest.Annotations = map[string]string{annotationRefName: "v2"}
+	index := Index{SchemaVersion: 2, Manifests: []Descriptor{manifest}}
+	b, _ := json.Marshal(index)
+	ioutil.WriteFile(fp.Join(dir, "index.json"), b, 0644)
+	return dir
+}
+
+func TestExportOCILayout(t *testing.T) {
+	dir := makeOCILayout(t)
+	defer os.RemoveAll(dir)
+
+	ref := "oci:" + dir + ":v2"
+	if !IsReference(ref) {
+		t.Fatalf("%s should be an image reference", ref)
+	}
+	src, err := Open(ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if info.Config.User != "app" || len(info.Config.Entrypoint) != 1 {
+		t.Errorf("should read image config: got %+v", info.Config)
+	}
+	r, err := Export(src, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+
+	files := readArchive(t, r)
+	if got, want := files["app"], "v2"; got != want {
+		t.Errorf("should apply layers in order: got %q, want %q", got, want)
+	}
+	if _, ok := files["tmp/build.log"]; ok {
+		t.Error("should apply whiteouts")
+	}
+	if got, want := files[environ.DROOT_ENV_FILE_PATH], "PATH=/usr/bin:/bin\n\n"; got != want {
+		t.Errorf("should write envs: got %q, want %q", got, want)
+	}
+	if _, ok := files[mounter.DROOT_BINDS_FILE_PATH]; !ok {
+		t.Error("should write binds")
+	}
+	m, err := manifest.Parse([]byte(files[manifest.DROOT_MANIFEST_FILE_PATH]))
+	if err != nil {
+		t.Fatalf("should write manifest: %v", err)
+	}
+	if m.Image != ref || m.ImageID != src.ID() || m.User != "app" {
+		t.Errorf("should write image config into manifest: got %+v", m)
+	}
+}
+
+func TestOpenOCILayoutUnknownTag(t *testing.T) {
+	dir := makeOCILayout(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := Open("oci:" + dir + ":v3"); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestOpenOCILayoutCorruptedBlob(t *testing.T) {
+	dir := makeOCILayout(t)
+	defer os.RemoveAll(dir)
+
+	src, err := Open("oci:" + dir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	layers, _ := src.Layers()
+	path, _ := blobPath(dir, layers[1].(*ociBlob).desc.Digest)
+	ioutil.WriteFile(path, makeLayer(testEntry{name: "app", typeflag: tar.TypeReg, body: "v3"}), 0644)
+
+	info, err := Inspect(src, "oci:"+dir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	r, _ := Export(src, info)
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("should be error on digest mismatch")
+	}
+}
@@ -0,0 +1,476 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	fp "path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerHubHost     = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+	dockerHubAuthKey  = "https://index.docker.io/v1/"
+)
+
+// registryClient gives up on registries which stop answering, without limiting
+// how long a large blob takes to download.
+var registryClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	},
+}
+
+// registry is a client of the Docker Registry HTTP API V2 for one repository.
+type registry struct {
+	client     *http.Client
+	scheme     string
+	host       string
+	repo       string
+	creds      *credentials
+	authHeader string
+}
+
+// registryImage is an image pulled from a registry.
+type registryImage struct {
+	reg      *registry
+	manifest Manifest
+}
+
+// registryBlob is a layer pulled from a registry.
+type registryBlob struct {
+	reg  *registry
+	desc Descriptor
+}
+
+type credentials struct {
+	username      string
+	password      string
+	identityToken string
+}
+
+// parseRegistryReference splits a reference of the form HOST/REPO[:TAG|@DIGEST].
+func parseRegistryReference(ref string) (host, repo, tag string, err error) {
+	i := strings.Index(ref, "/")
+	if i <= 0 || i == len(ref)-1 {
+		return "", "", "", errors.Errorf("Invalid registry reference %s", ref)
+	}
+	host, repo = ref[:i], ref[i+1:]
+	if i := strings.Index(repo, "@"); i >= 0 {
+		repo, tag = repo[:i], repo[i+1:]
+	} else if i := strings.LastIndex(repo, ":"); i >= 0 {
+		repo, tag = repo[:i], repo[i+1:]
+	} else {
+		tag = "latest"
+	}
+	if repo == "" || tag == "" {
+		return "", "", "", errors.Errorf("Invalid registry reference %s", ref)
+	}
+	if host == dockerHubHost {
+		host = dockerHubRegistry
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+	}
+	return host, repo, tag, nil
+}
+
+// isLocalhost reports whether a registry runs on this host, in which case plain HTTP is used like Docker does.
+func isLocalhost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// openRegistry resolves the image named by ref, given as HOST/REPO[:TAG|@DIGEST], for the host platform.
+func openRegistry(ref string) (Source, error) {
+	host, repo, tag, err := parseRegistryReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	reg := &registry{client: registryClient, scheme: "https", host: host, repo: repo}
+	if isLocalhost(host) {
+		reg.scheme = "http"
+	}
+	if reg.creds, err = lookupCredentials(host); err != nil {
+		return nil, errors.Wrapf(err, "Failed to read credentials for %s", host)
+	}
+	desc, b, err := reg.manifest(tag)
+	if err != nil {
+		return nil, err
+	}
+	for isIndex(desc.MediaType) {
+		var index Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode index %s", desc.Digest)
+		}
+		if desc, err = selectManifest(index.Manifests); err != nil {
+			return nil, err
+		}
+		if desc, b, err = reg.manifest(desc.Digest); err != nil {
+			return nil, err
+		}
+	}
+	img := &registryImage{reg: reg}
+	if err := json.Unmarshal(b, &img.manifest); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode manifest %s", desc.Digest)
+	}
+	return img, nil
+}
+
+// manifest fetches the manifest or index referenced by a tag or a digest, and verifies its digest.
+func (r *registry) manifest(ref string) (Descriptor, []byte, error) {
+	req, err := http.NewRequest("GET", r.url("manifests", ref), nil)
+	if err != nil {
+		return Descriptor{}, nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		MediaTypeOCIIndex, MediaTypeOCIManifest, MediaTypeDockerList, MediaTypeDockerManifest,
+	}, ", "))
+	resp, err := r.do(req)
+	if err != nil {
+		return Descriptor{}, nil, errors.Wrapf(err, "Failed to fetch manifest %s of %s", ref, r.repo)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Descriptor{}, nil, errors.Wrapf(err, "Failed to fetch manifest %s of %s", ref, r.repo)
+	}
+	sum := sha256.Sum256(b)
+	desc := Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(b)),
+	}
+	for _, expected := range []string{resp.Header.Get("Docker-Content-Digest"), ref} {
+		if strings.HasPrefix(expected, "sha256:") && expected != desc.Digest {
+			return Descriptor{}, nil, errors.Errorf("Digest mismatch of manifest %s: got %s", expected, desc.Digest)
+		}
+	}
+	var m struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(b, &m); err == nil && m.MediaType != "" {
+		desc.MediaType = m.MediaType
+	}
+	return desc, b, nil
+}
+
+// blob fetches a blob, verifying its digest as it is read.
+func (r *registry) blob(desc Descriptor) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", r.url("blobs", desc.Digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch blob %s of %s", desc.Digest, r.repo)
+	}
+	v, err := newVerifier(resp.Body, desc.Digest)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{v, resp.Body}, nil
+}
+
+func (r *registry) url(kind, ref string) string {
+	return r.scheme + "://" + r.host + "/v2/" + r.repo + "/" + kind + "/" + ref
+}
+
+// do sends the request, authenticating as the registry asks for. The registry is
+// authenticated with again once if it rejects the current authorization, which
+// happens when a token expires partway through a pull.
+func (r *registry) do(req *http.Request) (*http.Response, error) {
+	resp, err := r.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if r.authHeader, err = r.authenticate(challenge); err != nil {
+			return nil, err
+		}
+		if resp, err = r.send(req); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return resp, nil
+}
+
+func (r *registry) send(req *http.Request) (*http.Response, error) {
+	if r.authHeader != "" {
+		req.Header.Set("Authorization", r.authHeader)
+	}
+	return r.client.Do(req)
+}
+
+// authenticate answers a WWW-Authenticate challenge with the value of the Authorization header.
+func (r *registry) authenticate(challenge string) (string, error) {
+	i := strings.Index(challenge, " ")
+	if i < 0 {
+		return "", errors.Errorf("Unsupported authentication challenge %q", challenge)
+	}
+	scheme, params := strings.ToLower(challenge[:i]), parseChallengeParams(challenge[i+1:])
+	switch scheme {
+	case "basic":
+		if r.creds == nil {
+			return "", errors.Errorf("No credentials for %s", r.host)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(r.creds.username+":"+r.creds.password)), nil
+	case "bearer":
+		token, err := r.token(params)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to get token for %s", r.repo)
+		}
+		return "Bearer " + token, nil
+	}
+	return "", errors.Errorf("Unsupported authentication scheme %s", scheme)
+}
+
+// token gets a bearer token from the authorization server named in the challenge.
+func (r *registry) token(params map[string]string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Scheme == "" {
+		return "", errors.Errorf("Invalid realm %q", params["realm"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.repo + ":pull"
+	}
+	var req *http.Request
+	if r.creds != nil && r.creds.identityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {r.creds.identityToken},
+			"service":       {params["service"]},
+			"scope":         {scope},
+			"client_id":     {"droot"},
+		}
+		req, err = http.NewRequest("POST", realm.String(), strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		q := realm.Query()
+		q.Set("service", params["service"])
+		q.Set("scope", scope)
+		realm.RawQuery = q.Encode()
+		req, err = http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if r.creds != nil {
+			req.SetBasicAuth(r.creds.username, r.creds.password)
+		}
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s %s: %s", req.Method, realm.Host, resp.Status)
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return "", errors.New("Empty token")
+	}
+	return t.Token, nil
+}
+
+// parseChallengeParams parses the comma separated key="value" parameters of a challenge.
+func parseChallengeParams(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) > 0 {
+		i := strings.Index(s, "=")
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if end := strings.Index(s, ","); end >= 0 {
+			value, s = s[:end], s[end:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+	return params
+}
+
+// dockerConfigPath returns the path of the Docker client configuration, honouring DOCKER_CONFIG.
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return fp.Join(dir, "config.json")
+	}
+	return fp.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// lookupCredentials reads the credentials for host from the Docker client configuration,
+// asking credential helpers if they are configured.
+func lookupCredentials(host string) (*credentials, error) {
+	var config struct {
+		Auths map[string]struct {
+			Auth          string `json:"auth"`
+			Username      string `json:"username"`
+			Password      string `json:"password"`
+			IdentityToken string `json:"identitytoken"`
+		} `json:"auths"`
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if err := readJSON(dockerConfigPath(), &config); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == dockerHubRegistry {
+		keys = append([]string{dockerHubAuthKey}, keys...)
+	}
+	for _, key := range keys {
+		if helper, ok := config.CredHelpers[key]; ok {
+			return credentialHelper(helper, key)
+		}
+	}
+	if config.CredsStore != "" {
+		return credentialHelper(config.CredsStore, keys[0])
+	}
+	for _, key := range keys {
+		auth, ok := config.Auths[key]
+		if !ok {
+			continue
+		}
+		creds := &credentials{username: auth.Username, password: auth.Password, identityToken: auth.IdentityToken}
+		if auth.Auth != "" {
+			b, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid auth of %s", key)
+			}
+			userpass := strings.SplitN(string(b), ":", 2)
+			if len(userpass) != 2 {
+				return nil, errors.Errorf("Invalid auth of %s", key)
+			}
+			creds.username, creds.password = userpass[0], userpass[1]
+		}
+		return creds, nil
+	}
+	return nil, nil
+}
+
+// credentialHelper runs docker-credential-HELPER to get the credentials for serverURL.
+func credentialHelper(helper, serverURL string) (*credentials, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if strings.Contains(string(out)+stderr.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to run docker-credential-%s: %s", helper, strings.TrimSpace(stderr.String()))
+	}
+	var creds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return nil, errors.Wrapf(err, "Invalid output of docker-credential-%s", helper)
+	}
+	if creds.Username == "<token>" {
+		return &credentials{identityToken: creds.Secret}, nil
+	}
+	return &credentials{username: creds.Username, password: creds.Secret}, nil
+}
+
+func (i *registryImage) ID() string {
+	return i.manifest.Config.Digest
+}
+
+func (i *registryImage) Config() (*Config, error) {
+	r, err := i.reg.blob(i.manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch config %s", i.manifest.Config.Digest)
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode config %s", i.manifest.Config.Digest)
+	}
+	return &cfg, nil
+}
+
+func (i *registryImage) Layers() ([]Layer, error) {
+	layers := make([]Layer, 0, len(i.manifest.Layers))
+	for _, desc := range i.manifest.Layers {
+		layers = append(layers, &registryBlob{reg: i.reg, desc: desc})
+	}
+	return layers, nil
+}
+
+func (i *registryImage) Close() error {
+	return nil
+}
+
+func (b *registryBlob) Open() (io.ReadCloser, error) {
+	return b.reg.blob(b.desc)
+}
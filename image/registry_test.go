@@ -0,0 +1,276 @@
+package image
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	fp "path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry serves blobs and manifests like registry:2 behind a token server.
+type fakeRegistry struct {
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	token     string
+}
+
+func (f *fakeRegistry) add(mediaType string, b []byte) Descriptor {
+	sum := sha256.Sum256(b)
+	d := Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(b))}
+	f.blobs[d.Digest] = b
+	return d
+}
+
+func (f *fakeRegistry) addManifest(tag, mediaType string, v interface{}) Descriptor {
+	b, _ := json.Marshal(v)
+	d := f.add(mediaType, b)
+	f.manifests[d.Digest] = b
+	f.types[d.Digest] = mediaType
+	if tag != "" {
+		f.manifests[tag] = b
+		f.types[tag] = mediaType
+	}
+	return d
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "droot" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("scope") != "repository:team/app:pull" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"token":"` + f.token + `"}`))
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="fake",scope="repository:team/app:pull"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v2/team/app/manifests/"):
+		ref := strings.TrimPrefix(r.URL.Path, "/v2/team/app/manifests/")
+		b, ok := f.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[ref])
+		w.Write(b)
+	case strings.HasPrefix(r.URL.Path, "/v2/team/app/blobs/"):
+		b, ok := f.blobs[strings.TrimPrefix(r.URL.Path, "/v2/team/app/blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, Descriptor) {
+	f := &fakeRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}, types: map[string]string{}, token: "t0ken"}
+	config, _ := json.Marshal(map[string]interface{}{
+		"config": map[string]interface{}{"Env": []string{"APP=1"}, "Cmd": []string{"serve"}},
+	})
+	layer := f.add("application/vnd.docker.image.rootfs.diff.tar.gzip", gzipped(makeLayer(
+		testEntry{name: "srv/", typeflag: tar.TypeDir},
+		testEntry{name: "srv/app", typeflag: tar.TypeReg, body: "app"},
+	)))
+	manifest := f.addManifest("", MediaTypeDockerManifest, Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeDockerManifest,
+		Config:        f.add("application/vnd.docker.container.image.v1+json", config),
+		Layers:        []Descriptor{layer},
+	})
+	manifest.Platform = &Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	other := manifest
+	other.Digest = "sha256:" + strings.Repeat("0", 64)
+	other.Platform = &Platform{OS: "windows", Architecture: "s390x"}
+	f.addManifest("v1", MediaTypeDockerList, Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeDockerList,
+		Manifests:     []Descriptor{other, manifest},
+	})
+	return f, layer
+}
+
+func withDockerConfig(t *testing.T, host string) func() {
+	dir, err := ioutil.TempDir("", "droot_docker_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("droot:secret"))
+	ioutil.WriteFile(fp.Join(dir, "config.json"), []byte(`{"auths":{"`+host+`":{"auth":"`+auth+`"}}}`), 0600)
+	old := os.Getenv("DOCKER_CONFIG")
+	os.Setenv("DOCKER_CONFIG", dir)
+	return func() {
+		os.Setenv("DOCKER_CONFIG", old)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExportRegistry(t *testing.T) {
+	f, _ := newFakeRegistry(t)
+	server := httptest.NewServer(f)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer withDockerConfig(t, host)()
+
+	ref := "registry://" + host + "/team/app:v1"
+	src, err := Open(ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(info.Config.Cmd) != 1 || info.Config.Cmd[0] != "serve" {
+		t.Errorf("should read image config: got %+v", info.Config)
+	}
+	r, err := Export(src, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	files := readArchive(t, r)
+	if got, want := files["srv/app"], "app"; got != want {
+		t.Errorf("should pull layers: got %q, want %q", got, want)
+	}
+}
+
+func TestExportRegistryCorruptedBlob(t *testing.T) {
+	f, layer := newFakeRegistry(t)
+	f.blobs[layer.Digest] = gzipped(makeLayer(testEntry{name: "srv/app", typeflag: tar.TypeReg, body: "evil"}))
+	server := httptest.NewServer(f)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer withDockerConfig(t, host)()
+
+	ref := "registry://" + host + "/team/app:v1"
+	src, err := Open(ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	r, _ := Export(src, info)
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("should be error on digest mismatch")
+	}
+}
+
+func TestExportRegistryExpiredToken(t *testing.T) {
+	f, _ := newFakeRegistry(t)
+	server := httptest.NewServer(f)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer withDockerConfig(t, host)()
+
+	ref := "registry://" + host + "/team/app:v1"
+	src, err := Open(ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer src.Close()
+	info, err := Inspect(src, ref)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// The token expires before the layers are pulled.
+	f.token = "n3w-t0ken"
+	r, err := Export(src, info)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer r.Close()
+	files := readArchive(t, r)
+	if got, want := files["srv/app"], "app"; got != want {
+		t.Errorf("should pull layers with a new token: got %q, want %q", got, want)
+	}
+}
+
+func TestSelectPlatform(t *testing.T) {
+	manifests := []Descriptor{
+		{Digest: "amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "armv6", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: "armv7", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: "arm64", Platform: &Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+	}
+	cases := []struct {
+		arch     string
+		variants []string
+		digest   string
+	}{
+		{"amd64", []string{"", "v1"}, "amd64"},
+		{"arm", []string{"v7", "v6", "v5", ""}, "armv7"},
+		{"arm", []string{"v6", "v5", ""}, "armv6"},
+		{"arm", nil, "armv6"},
+		{"arm64", []string{"v8", ""}, "arm64"},
+	}
+	for _, c := range cases {
+		d, err := selectPlatform(manifests, "linux", c.arch, c.variants)
+		if err != nil {
+			t.Errorf("%s %v should not be error: %v", c.arch, c.variants, err)
+		} else if d.Digest != c.digest {
+			t.Errorf("%s %v: got %s, want %s", c.arch, c.variants, d.Digest, c.digest)
+		}
+	}
+	if _, err := selectPlatform(manifests, "linux", "arm", []string{"v5", ""}); err == nil {
+		t.Error("should be error without an image for the variant")
+	}
+}
+
+func TestOpenRegistryUnauthorized(t *testing.T) {
+	f, _ := newFakeRegistry(t)
+	server := httptest.NewServer(f)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer withDockerConfig(t, "other.example.com")()
+
+	if _, err := Open("registry://" + host + "/team/app:v1"); err == nil {
+		t.Error("should be error without credentials")
+	}
+}
+
+func TestParseRegistryReference(t *testing.T) {
+	cases := map[string][3]string{
+		"localhost:5000/team/app:v1":     {"localhost:5000", "team/app", "v1"},
+		"quay.io/team/app":               {"quay.io", "team/app", "latest"},
+		"docker.io/alpine":               {"registry-1.docker.io", "library/alpine", "latest"},
+		"host/app@sha256:0123456789abcd": {"host", "app", "sha256:0123456789abcd"},
+	}
+	for ref, expected := range cases {
+		host, repo, tag, err := parseRegistryReference(ref)
+		if err != nil {
+			t.Errorf("%s should not be error: %v", ref, err)
+		}
+		if got := [3]string{host, repo, tag}; got != expected {
+			t.Errorf("%s: got %v, want %v", ref, got, expected)
+		}
+	}
+	if _, _, _, err := parseRegistryReference("app"); err == nil {
+		t.Error("should be error without host")
+	}
+}
@@ -0,0 +1,71 @@
+package landlock
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Access rights of files of Landlock, from linux/landlock.h.
+// Each ABI version of Landlock handles more rights than the previous one.
+const (
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeChar   = 1 << 6
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessMakeSock   = 1 << 9
+	accessMakeFifo   = 1 << 10
+	accessMakeBlock  = 1 << 11
+	accessMakeSym    = 1 << 12
+	accessRefer      = 1 << 13 // ABI 2
+	accessTruncate   = 1 << 14 // ABI 3
+	accessIoctlDev   = 1 << 15 // ABI 5
+)
+
+// accessFile are the rights which apply to files, rather than to directories.
+const accessFile = accessExecute | accessWriteFile | accessReadFile | accessTruncate | accessIoctlDev
+
+const accessRead = accessExecute | accessReadFile | accessReadDir
+
+// ErrNotSupported is returned by Restrict when the kernel does not support Landlock,
+// or it is disabled.
+var ErrNotSupported = errors.New("Landlock is not supported by the kernel")
+
+// Rule allows to read and execute the files beneath Path, and to write them if Writable.
+type Rule struct {
+	Path     string
+	Writable bool
+}
+
+// handledAccess returns the rights Landlock handles with the ABI version abi.
+// The rights it does not handle are allowed everywhere.
+func handledAccess(abi int) uint64 {
+	access := uint64(accessExecute | accessWriteFile | accessReadFile | accessReadDir |
+		accessRemoveDir | accessRemoveFile | accessMakeChar | accessMakeDir | accessMakeReg |
+		accessMakeSock | accessMakeFifo | accessMakeBlock | accessMakeSym)
+	if abi >= 2 {
+		access |= accessRefer
+	}
+	if abi >= 3 {
+		access |= accessTruncate
+	}
+	if abi >= 5 {
+		access |= accessIoctlDev
+	}
+	return access
+}
+
+// allowedAccess returns the rights a rule allows on a directory or a file, among handled.
+func allowedAccess(r Rule, dir bool, handled uint64) uint64 {
+	access := uint64(accessRead)
+	if r.Writable {
+		access = handled
+	}
+	if !dir {
+		access &= accessFile
+	}
+	return access & handled
+}
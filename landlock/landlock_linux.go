@@ -0,0 +1,92 @@
+package landlock
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/asmyasnikov/droot/log"
+)
+
+// Syscall numbers of Landlock, which are the same on all the architectures droot builds for.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+)
+
+const (
+	createRulesetVersion = 1 << 0 // LANDLOCK_CREATE_RULESET_VERSION
+	rulePathBeneath      = 1      // LANDLOCK_RULE_PATH_BENEATH
+)
+
+type rulesetAttr struct {
+	handledAccessFs uint64
+}
+
+// pathBeneathAttr is struct landlock_path_beneath_attr. It is packed, which only leaves out
+// the padding at the end of the Go struct.
+type pathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// ABI returns the version of the Landlock ABI of the kernel.
+func ABI() (int, error) {
+	v, _, e1 := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, createRulesetVersion)
+	if e1 == syscall.ENOSYS || e1 == syscall.EOPNOTSUPP {
+		return 0, ErrNotSupported
+	}
+	if e1 != 0 {
+		return 0, e1
+	}
+	return int(v), nil
+}
+
+// Restrict restricts the access of the calling thread, and of the programs it executes,
+// to the files beneath the paths of rules. It requires either CAP_SYS_ADMIN or no_new_privs
+// set on the thread, and returns ErrNotSupported if the kernel has no Landlock.
+func Restrict(rules []Rule) error {
+	abi, err := ABI()
+	if err != nil {
+		return err
+	}
+	handled := handledAccess(abi)
+	attr := rulesetAttr{handledAccessFs: handled}
+	fd, _, e1 := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if e1 != 0 {
+		return errors.Wrapf(e1, "Failed to create Landlock ruleset")
+	}
+	defer unix.Close(int(fd))
+
+	for _, r := range rules {
+		if err := addRule(int(fd), r, handled); err != nil {
+			return errors.Wrapf(err, "Failed to add Landlock rule for %s", r.Path)
+		}
+	}
+	log.Debug("landlock_restrict_self", rules)
+	if _, _, e1 := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); e1 != 0 {
+		return errors.Wrapf(e1, "Failed to restrict with Landlock")
+	}
+	return nil
+}
+
+func addRule(rulesetFd int, r Rule, handled uint64) error {
+	fd, err := unix.Open(r.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	access := allowedAccess(r, st.Mode&unix.S_IFMT == unix.S_IFDIR, handled)
+	attr := pathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+	if _, _, e1 := syscall.Syscall6(sysLandlockAddRule, uintptr(rulesetFd), rulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); e1 != 0 {
+		return e1
+	}
+	return nil
+}
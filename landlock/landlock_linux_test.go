@@ -0,0 +1,62 @@
+package landlock
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	fp "path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestRestrictProcess restricts itself to write only beneath DROOT_TEST_LANDLOCK, run by TestRestrict.
+func TestRestrictProcess(t *testing.T) {
+	dir := os.Getenv("DROOT_TEST_LANDLOCK")
+	if dir == "" {
+		t.Skip("run by TestRestrict")
+	}
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := Restrict([]Rule{{Path: "/"}, {Path: fp.Join(dir, "rw"), Writable: true}}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// Files are opened by the locked thread, which is the one restricted.
+	if err := unix.Mkdir(fp.Join(dir, "rw/dir"), 0755); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := unix.Mkdir(fp.Join(dir, "ro/dir"), 0755); err != unix.EACCES {
+		t.Fatalf("mkdir in a read-only directory should fail with EACCES: %v", err)
+	}
+	if _, err := unix.Open(fp.Join(dir, "ro/file"), unix.O_RDONLY, 0); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	if _, err := ABI(); err == ErrNotSupported {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "droot_landlock")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"ro", "rw"} {
+		if err := os.Mkdir(fp.Join(dir, d), 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, "ro/file"), []byte("droot"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrictProcess$")
+	cmd.Env = append(os.Environ(), "DROOT_TEST_LANDLOCK="+dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("should not be error: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package landlock
+
+func ABI() (int, error) {
+	return 0, ErrNotSupported
+}
+
+func Restrict(rules []Rule) error {
+	return ErrNotSupported
+}
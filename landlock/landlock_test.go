@@ -0,0 +1,26 @@
+package landlock
+
+import (
+	"testing"
+)
+
+func TestAllowedAccess(t *testing.T) {
+	cases := []struct {
+		rule   Rule
+		dir    bool
+		abi    int
+		expect uint64
+	}{
+		{Rule{Path: "/"}, true, 1, accessExecute | accessReadFile | accessReadDir},
+		{Rule{Path: "/bin/sh"}, false, 5, accessExecute | accessReadFile},
+		{Rule{Path: "/tmp", Writable: true}, true, 1, 0x1fff},
+		{Rule{Path: "/tmp", Writable: true}, true, 3, 0x7fff},
+		{Rule{Path: "/dev/null", Writable: true}, false, 5, accessExecute | accessWriteFile | accessReadFile | accessTruncate | accessIoctlDev},
+		{Rule{Path: "/dev/null", Writable: true}, false, 1, accessExecute | accessWriteFile | accessReadFile},
+	}
+	for _, c := range cases {
+		if got := allowedAccess(c.rule, c.dir, handledAccess(c.abi)); got != c.expect {
+			t.Errorf("%+v on ABI %d: expected %#x, got %#x", c.rule, c.abi, c.expect, got)
+		}
+	}
+}
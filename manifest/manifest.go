@@ -0,0 +1,337 @@
+package manifest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/mounter"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// DROOT_MANIFEST_FILE_PATH is the file path of the container manifest for `droot run`.
+const DROOT_MANIFEST_FILE_PATH = ".droot/config.json"
+
+// Version is the version of the manifest format written by this droot.
+// Manifests of newer versions are refused, since they may require features
+// this droot does not know about.
+const Version = 1
+
+// Manifest describes how to run an exported container.
+type Manifest struct {
+	Version        int               `json:"version"`
+	Image          string            `json:"image,omitempty"`
+	ImageID        string            `json:"imageId,omitempty"` // the digest of the image config, not a repo digest
+	Entrypoint     []string          `json:"entrypoint,omitempty"`
+	Cmd            []string          `json:"cmd,omitempty"`
+	Env            []string          `json:"env,omitempty"`
+	WorkingDir     string            `json:"workingDir,omitempty"`
+	User           string            `json:"user,omitempty"`
+	Binds          []string          `json:"binds,omitempty"` // SRC-PATH:DEST-PATH[:OPTIONS], as --bind
+	Ports          []Port            `json:"ports,omitempty"`
+	Ulimits        []Ulimit          `json:"ulimits,omitempty"`
+	Memory         int64             `json:"memory,omitempty"`   // bytes
+	NanoCPUs       int64             `json:"nanoCpus,omitempty"` // CPU quota in units of 10^-9 CPUs
+	StopSignal     string            `json:"stopSignal,omitempty"`
+	StopTimeout    *int              `json:"stopTimeout,omitempty"` // seconds
+	Healthcheck    *Healthcheck      `json:"healthcheck,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	RestartPolicy  *RestartPolicy    `json:"restartPolicy,omitempty"`
+	CapAdd         []string          `json:"capAdd,omitempty"`
+	CapDrop        []string          `json:"capDrop,omitempty"`
+	MaskedPaths    []string          `json:"maskedPaths,omitempty"`   // mounter.DefaultMaskedPaths if nil
+	ReadonlyPaths  []string          `json:"readonlyPaths,omitempty"` // mounter.DefaultReadonlyPaths if nil
+	ReadonlyRootfs bool              `json:"readonlyRootfs,omitempty"`
+	Tmpfs          []string          `json:"tmpfs,omitempty"`   // DEST-PATH[:OPTIONS], as --tmpfs
+	Volumes        []string          `json:"volumes,omitempty"` // [NAME:]DEST-PATH[:OPTIONS], as --volume
+}
+
+// Port is a port exposed by the container, and the host address it was published on.
+type Port struct {
+	Port     string `json:"port"` // e.g. 80/tcp
+	HostIP   string `json:"hostIp,omitempty"`
+	HostPort string `json:"hostPort,omitempty"`
+}
+
+// Ulimit is a resource limit of the container, e.g. nofile.
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+// Healthcheck is the command which checks the container is healthy.
+type Healthcheck struct {
+	Test        []string      `json:"test,omitempty"`
+	Interval    time.Duration `json:"interval,omitempty"`
+	Timeout     time.Duration `json:"timeout,omitempty"`
+	StartPeriod time.Duration `json:"startPeriod,omitempty"`
+	Retries     int           `json:"retries,omitempty"`
+}
+
+// RestartPolicy is when the container is restarted: no, always, unless-stopped or on-failure.
+type RestartPolicy struct {
+	Name              string `json:"name"`
+	MaximumRetryCount int    `json:"maximumRetryCount,omitempty"`
+}
+
+// FromContainer returns the manifest of a container inspected by Docker or read from an image.
+func FromContainer(info *types.ContainerJSON) *Manifest {
+	m := &Manifest{Version: Version}
+	if strings.HasPrefix(info.Image, "sha256:") {
+		m.ImageID = info.Image
+	}
+	if c := info.Config; c != nil {
+		m.Image = c.Image
+		m.Entrypoint = c.Entrypoint
+		m.Cmd = c.Cmd
+		m.Env = c.Env
+		m.WorkingDir = c.WorkingDir
+		m.User = c.User
+		m.StopSignal = c.StopSignal
+		m.StopTimeout = c.StopTimeout
+		if len(c.Labels) > 0 {
+			m.Labels = c.Labels
+		}
+		if h := c.Healthcheck; h != nil && len(h.Test) > 0 {
+			m.Healthcheck = &Healthcheck{
+				Test:        h.Test,
+				Interval:    h.Interval,
+				Timeout:     h.Timeout,
+				StartPeriod: h.StartPeriod,
+				Retries:     h.Retries,
+			}
+		}
+		for p := range c.ExposedPorts {
+			m.Ports = append(m.Ports, Port{Port: string(p)})
+		}
+	}
+	m.Volumes = volumesFromContainer(info)
+	for _, mo := range info.Mounts {
+		if mo.Type != mount.TypeBind {
+			continue
+		}
+		var opts []string
+		if !mo.RW {
+			opts = append(opts, "ro")
+		}
+		// Docker binds are rprivate by default.
+		if mo.Propagation != "" && mo.Propagation != mount.PropagationRPrivate {
+			opts = append(opts, string(mo.Propagation))
+		}
+		bind := mo.Source + ":" + mo.Destination
+		if len(opts) > 0 {
+			bind += ":" + strings.Join(opts, ",")
+		}
+		m.Binds = append(m.Binds, bind)
+	}
+	if h := info.HostConfig; h != nil {
+		for p, bindings := range h.PortBindings {
+			for _, b := range bindings {
+				m.Ports = append(m.Ports, Port{Port: string(p), HostIP: b.HostIP, HostPort: b.HostPort})
+			}
+		}
+		for _, l := range h.Ulimits {
+			m.Ulimits = append(m.Ulimits, Ulimit{Name: l.Name, Soft: l.Soft, Hard: l.Hard})
+		}
+		m.Memory = h.Memory
+		m.NanoCPUs = h.NanoCPUs
+		m.CapAdd = h.CapAdd
+		m.CapDrop = h.CapDrop
+		m.ReadonlyRootfs = h.ReadonlyRootfs
+		m.Tmpfs = tmpfsFromContainer(h)
+		if h.RestartPolicy.Name != "" && h.RestartPolicy.Name != "no" {
+			m.RestartPolicy = &RestartPolicy{Name: h.RestartPolicy.Name, MaximumRetryCount: h.RestartPolicy.MaximumRetryCount}
+		}
+	}
+	// Maps are iterated in random order, so sort ports to write the same manifest every time.
+	sort.SliceStable(m.Ports, func(i, j int) bool {
+		return m.Ports[i].Port < m.Ports[j].Port
+	})
+	return m
+}
+
+// anonymousVolumeName is the pattern of the names Docker gives to anonymous volumes.
+var anonymousVolumeName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// volumesFromContainer returns the volumes of a container: its named volumes, which droot mounts from
+// its volume store by name, and its anonymous ones, which droot creates for the container. The volumes
+// of the image not mounted by the container, such as the ones of an image exported alone, are anonymous.
+func volumesFromContainer(info *types.ContainerJSON) []string {
+	var volumes []string
+	mounted := map[string]bool{}
+	for _, mo := range info.Mounts {
+		if mo.Type != mount.TypeVolume {
+			continue
+		}
+		mounted[mo.Destination] = true
+		volume := mo.Destination
+		if mo.Name != "" && !anonymousVolumeName.MatchString(mo.Name) {
+			volume = mo.Name + ":" + volume
+		}
+		if !mo.RW {
+			volume += ":ro"
+		}
+		volumes = append(volumes, volume)
+	}
+	if info.Config == nil {
+		return volumes
+	}
+	var anonymous []string
+	for dest := range info.Config.Volumes {
+		if !mounted[dest] {
+			anonymous = append(anonymous, dest)
+		}
+	}
+	// Maps are iterated in random order.
+	sort.Strings(anonymous)
+	return append(volumes, anonymous...)
+}
+
+// tmpfsFromContainer returns the tmpfs mounts of a container, of --tmpfs and of --mount type=tmpfs of Docker.
+func tmpfsFromContainer(h *container.HostConfig) []string {
+	var tmpfs []string
+	for dest, opts := range h.Tmpfs {
+		if opts != "" {
+			dest += ":" + opts
+		}
+		tmpfs = append(tmpfs, dest)
+	}
+	// Maps are iterated in random order.
+	sort.Strings(tmpfs)
+	for _, mo := range h.Mounts {
+		if mo.Type != mount.TypeTmpfs {
+			continue
+		}
+		var opts []string
+		if mo.ReadOnly {
+			opts = append(opts, "ro")
+		}
+		if o := mo.TmpfsOptions; o != nil {
+			if o.SizeBytes > 0 {
+				opts = append(opts, "size="+strconv.FormatInt(o.SizeBytes, 10))
+			}
+			if o.Mode != 0 {
+				mode := uint32(o.Mode.Perm())
+				if o.Mode&os.ModeSticky != 0 {
+					mode |= 01000
+				}
+				opts = append(opts, "mode="+strconv.FormatUint(uint64(mode), 8))
+			}
+		}
+		dest := mo.Target
+		if len(opts) > 0 {
+			dest += ":" + strings.Join(opts, ",")
+		}
+		tmpfs = append(tmpfs, dest)
+	}
+	return tmpfs
+}
+
+// Marshal returns the manifest as it is written in DROOT_MANIFEST_FILE_PATH.
+func (m *Manifest) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Parse parses a manifest and refuses versions newer than Version.
+func Parse(b []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse manifest")
+	}
+	if m.Version < 1 || m.Version > Version {
+		return nil, errors.Errorf("Unsupported manifest version %d, droot supports up to %d", m.Version, Version)
+	}
+	return &m, nil
+}
+
+// Load reads the manifest of the container in rootDir.
+// Containers exported by older droot have no manifest, so their env and binds
+// are read from DROOT_ENV_FILE_PATH and DROOT_BINDS_FILE_PATH instead.
+func Load(rootDir string) (*Manifest, error) {
+	path := fp.Join(rootDir, DROOT_MANIFEST_FILE_PATH)
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		m, err := Parse(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to load %s", path)
+		}
+		for _, legacy := range changedLegacyFiles(rootDir) {
+			log.Infof("%s has changed since %s was written, but is ignored: edit %s instead", legacy, path, path)
+		}
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Failed to read %s", path)
+	}
+
+	m := &Manifest{Version: Version}
+	if path := fp.Join(rootDir, environ.DROOT_ENV_FILE_PATH); osutil.ExistsFile(path) {
+		if m.Env, err = environ.ReadEnvFile(path); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read %s", path)
+		}
+	}
+	if path := fp.Join(rootDir, mounter.DROOT_BINDS_FILE_PATH); osutil.ExistsFile(path) {
+		if m.Binds, err = mounter.ReadBindsFile(path); err != nil {
+			return nil, errors.Wrapf(err, "Failed to read %s", path)
+		}
+	}
+	return m, nil
+}
+
+// changedLegacyFiles returns DROOT_ENV_FILE_PATH and DROOT_BINDS_FILE_PATH of the container
+// in rootDir if they have been modified after the manifest. Export writes them along with
+// the manifest for older droot, but they are ignored once the container has a manifest.
+func changedLegacyFiles(rootDir string) []string {
+	mfi, err := os.Stat(fp.Join(rootDir, DROOT_MANIFEST_FILE_PATH))
+	if err != nil {
+		return nil
+	}
+	var changed []string
+	for _, name := range []string{environ.DROOT_ENV_FILE_PATH, mounter.DROOT_BINDS_FILE_PATH} {
+		path := fp.Join(rootDir, name)
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(mfi.ModTime()) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
+
+// Command returns the command line of the container following the rules of Docker:
+// args replace the CMD of the image and are appended to its ENTRYPOINT.
+// A non-nil entrypoint replaces the ENTRYPOINT of the image and resets its CMD,
+// and an empty entrypoint clears the ENTRYPOINT.
+func (m *Manifest) Command(entrypoint *string, args []string) ([]string, error) {
+	ep, cmd := m.Entrypoint, m.Cmd
+	if entrypoint != nil {
+		ep, cmd = nil, nil
+		if *entrypoint != "" {
+			ep = []string{*entrypoint}
+		}
+	}
+	if len(args) > 0 {
+		cmd = args
+	}
+	command := append(append([]string{}, ep...), cmd...)
+	if len(command) == 0 {
+		return nil, errors.New("No command specified, and the container has no entrypoint or cmd")
+	}
+	return command, nil
+}
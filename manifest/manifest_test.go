@@ -0,0 +1,179 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/asmyasnikov/droot/environ"
+	"github.com/asmyasnikov/droot/mounter"
+)
+
+func TestFromContainer(t *testing.T) {
+	timeout := 30
+	m := FromContainer(&types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			Image: "sha256:aaaaaaaaaaaa",
+			HostConfig: &container.HostConfig{
+				RestartPolicy:  container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3},
+				ReadonlyRootfs: true,
+				Tmpfs:          map[string]string{"/tmp": "size=64m", "/run": ""},
+				Mounts: []mount.Mount{
+					{Type: mount.TypeTmpfs, Target: "/cache", TmpfsOptions: &mount.TmpfsOptions{SizeBytes: 1 << 20, Mode: 0777 | os.ModeSticky}},
+					{Type: mount.TypeBind, Source: "/var/log/app", Target: "/var/log/app"},
+				},
+			},
+		},
+		Mounts: []types.MountPoint{
+			{Type: mount.TypeBind, Source: "/var/log/app", Destination: "/var/log/app", RW: true},
+			{Type: mount.TypeBind, Source: "/etc/app", Destination: "/etc/app"},
+			{Type: mount.TypeBind, Source: "/run/app", Destination: "/run/app", RW: true, Propagation: mount.PropagationRSlave},
+			{Type: mount.TypeVolume, Name: "data", Source: "/var/lib/docker/volumes/data/_data", Destination: "/data", RW: true},
+			{Type: mount.TypeVolume, Name: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", Source: "/var/lib/docker/volumes/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/_data", Destination: "/cache"},
+		},
+		Config: &container.Config{
+			Image:       "dockerfiles/app",
+			Entrypoint:  []string{"/docker-entrypoint.sh"},
+			Cmd:         []string{"app", "serve"},
+			Env:         []string{"PATH=/usr/bin:/bin"},
+			StopSignal:  "SIGQUIT",
+			StopTimeout: &timeout,
+			Volumes:     map[string]struct{}{"/data": {}, "/var/lib/app": {}, "/var/cache/app": {}},
+		},
+	})
+	expected := &Manifest{
+		Version:        Version,
+		Image:          "dockerfiles/app",
+		ImageID:        "sha256:aaaaaaaaaaaa",
+		Entrypoint:     []string{"/docker-entrypoint.sh"},
+		Cmd:            []string{"app", "serve"},
+		Env:            []string{"PATH=/usr/bin:/bin"},
+		Binds:          []string{"/var/log/app:/var/log/app", "/etc/app:/etc/app:ro", "/run/app:/run/app:rslave"},
+		StopSignal:     "SIGQUIT",
+		StopTimeout:    &timeout,
+		RestartPolicy:  &RestartPolicy{Name: "on-failure", MaximumRetryCount: 3},
+		ReadonlyRootfs: true,
+		Tmpfs:          []string{"/run", "/tmp:size=64m", "/cache:size=1048576,mode=1777"},
+		Volumes:        []string{"data:/data", "/cache:ro", "/var/cache/app", "/var/lib/app"},
+	}
+	if diff := pretty.Compare(m, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	parsed, err := Parse(b)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(parsed, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestParseNewerVersion(t *testing.T) {
+	if _, err := Parse([]byte(`{"version": 1000}`)); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A container exported by an older droot.
+	if err := ioutil.WriteFile(fp.Join(dir, environ.DROOT_ENV_FILE_PATH), []byte("PATH=/usr/bin:/bin\nLANG=C\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, mounter.DROOT_BINDS_FILE_PATH), []byte("/var/log/app:/var/log/app\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(dir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected := &Manifest{
+		Version: Version,
+		Env:     []string{"PATH=/usr/bin:/bin", "LANG=C"},
+		Binds:   []string{"/var/log/app:/var/log/app"},
+	}
+	if diff := pretty.Compare(m, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The manifest takes precedence over the legacy files.
+	if err := os.MkdirAll(fp.Join(dir, fp.Dir(DROOT_MANIFEST_FILE_PATH)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fp.Join(dir, DROOT_MANIFEST_FILE_PATH), []byte(`{"version": 1, "env": ["LANG=C.UTF-8"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = Load(dir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected = &Manifest{Version: Version, Env: []string{"LANG=C.UTF-8"}}
+	if diff := pretty.Compare(m, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// Legacy files written along with the manifest are not reported, but later edits are.
+	written := time.Date(2017, 6, 19, 1, 32, 42, 0, time.UTC)
+	for _, name := range []string{DROOT_MANIFEST_FILE_PATH, environ.DROOT_ENV_FILE_PATH, mounter.DROOT_BINDS_FILE_PATH} {
+		if err := os.Chtimes(fp.Join(dir, name), written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changed := changedLegacyFiles(dir); len(changed) != 0 {
+		t.Errorf("unchanged legacy files should not be reported: %v", changed)
+	}
+	if err := os.Chtimes(fp.Join(dir, environ.DROOT_ENV_FILE_PATH), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare(changedLegacyFiles(dir), []string{fp.Join(dir, environ.DROOT_ENV_FILE_PATH)}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	empty, sh := "", "/bin/sh"
+	m := &Manifest{Entrypoint: []string{"/docker-entrypoint.sh"}, Cmd: []string{"app", "serve"}}
+	cases := []struct {
+		manifest   *Manifest
+		entrypoint *string
+		args       []string
+		expected   []string
+	}{
+		{m, nil, nil, []string{"/docker-entrypoint.sh", "app", "serve"}},
+		{m, nil, []string{"app", "migrate"}, []string{"/docker-entrypoint.sh", "app", "migrate"}},
+		{m, &sh, nil, []string{"/bin/sh"}},
+		{m, &sh, []string{"-c", "id"}, []string{"/bin/sh", "-c", "id"}},
+		{m, &empty, []string{"id"}, []string{"id"}},
+		{&Manifest{Cmd: []string{"bash"}}, nil, nil, []string{"bash"}},
+		{&Manifest{Cmd: []string{"bash"}}, nil, []string{"id", "-u"}, []string{"id", "-u"}},
+	}
+	for _, c := range cases {
+		command, err := c.manifest.Command(c.entrypoint, c.args)
+		if err != nil {
+			t.Errorf("should not be error: %v", err)
+		}
+		if diff := pretty.Compare(command, c.expected); diff != "" {
+			t.Errorf("diff: (-actual +expected)\n%s", diff)
+		}
+	}
+
+	if _, err := (&Manifest{}).Command(&empty, nil); err == nil {
+		t.Error("should be error")
+	}
+}
@@ -0,0 +1,220 @@
+package mounter
+
+import (
+	"os"
+	fp "path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/docker/docker/pkg/mount"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// Device is a device node of the container.
+type Device struct {
+	Path  string // in the container
+	Type  uint32 // unix.S_IFCHR or unix.S_IFBLK
+	Major int64
+	Minor int64
+	Mode  os.FileMode
+	Uid   int
+	Gid   int
+}
+
+// DefaultDevices are the devices of every container, as in Docker.
+var DefaultDevices = []Device{
+	{Path: "/dev/null", Type: unix.S_IFCHR, Major: 1, Minor: 3, Mode: 0666},
+	{Path: "/dev/zero", Type: unix.S_IFCHR, Major: 1, Minor: 5, Mode: 0666},
+	{Path: "/dev/full", Type: unix.S_IFCHR, Major: 1, Minor: 7, Mode: 0666},
+	{Path: "/dev/random", Type: unix.S_IFCHR, Major: 1, Minor: 8, Mode: 0666},
+	{Path: "/dev/urandom", Type: unix.S_IFCHR, Major: 1, Minor: 9, Mode: 0666},
+	{Path: "/dev/tty", Type: unix.S_IFCHR, Major: 5, Minor: 0, Mode: 0666},
+}
+
+// devSymlinks are the symlinks of /dev, in the order they are created.
+var devSymlinks = [][2]string{
+	{"/proc/self/fd", "/dev/fd"},
+	{"/proc/self/fd/0", "/dev/stdin"},
+	{"/proc/self/fd/1", "/dev/stdout"},
+	{"/proc/self/fd/2", "/dev/stderr"},
+	{"pts/ptmx", "/dev/ptmx"},
+}
+
+// parseDeviceOption parses HOST-PATH[:CONTAINER-PATH][:PERMISSIONS] of --device into the device of the host.
+// The permissions are any of r, w and m as in Docker, and the device node is made unreadable without r,
+// and unwritable without w. m, which lets the container create the device with mknod(2), is not enforced.
+func parseDeviceOption(deviceOption string) (Device, error) {
+	var dev Device
+	d := strings.SplitN(deviceOption, ":", 3)
+	hostPath, containerPath, perms := d[0], d[0], "rwm"
+	switch len(d) {
+	case 3:
+		containerPath, perms = d[1], d[2]
+	case 2:
+		if isDevicePermissions(d[1]) {
+			perms = d[1]
+		} else {
+			containerPath = d[1]
+		}
+	}
+	if !isDevicePermissions(perms) {
+		return dev, errors.Errorf("Invalid device permissions '%s' of %s", perms, deviceOption)
+	}
+	if !fp.IsAbs(hostPath) {
+		return dev, errors.Errorf("%s is not an absolute path", hostPath)
+	}
+	if !fp.IsAbs(containerPath) {
+		return dev, errors.Errorf("%s is not an absolute path", containerPath)
+	}
+
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return dev, errors.Wrapf(err, "Failed to stat device %s", hostPath)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || fi.Mode()&os.ModeDevice == 0 {
+		return dev, errors.Errorf("%s is not a device", hostPath)
+	}
+	dev = Device{
+		Path:  fp.Clean(containerPath),
+		Type:  unix.S_IFBLK,
+		Major: osutil.Major(uint64(st.Rdev)),
+		Minor: osutil.Minor(uint64(st.Rdev)),
+		Mode:  fi.Mode().Perm(),
+		Uid:   int(st.Uid),
+		Gid:   int(st.Gid),
+	}
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		dev.Type = unix.S_IFCHR
+	}
+	if !strings.Contains(perms, "r") {
+		dev.Mode &^= 0444
+	}
+	if !strings.Contains(perms, "w") {
+		dev.Mode &^= 0222
+	}
+	return dev, nil
+}
+
+func isDevicePermissions(perms string) bool {
+	if perms == "" {
+		return false
+	}
+	for _, p := range perms {
+		if !strings.ContainsRune("rwm", p) {
+			return false
+		}
+	}
+	return true
+}
+
+// MountDev mounts a fresh /dev on the container as Docker does: a tmpfs with the default devices and
+// the devices of the host of deviceOpts, a devpts instance of its own, a tmpfs on /dev/shm and the
+// usual symlinks. console, the terminal of an interactive run if any, is bind mounted on /dev/console.
+// A /dev mounted already, by a previous run without a mount namespace, is reused.
+func (m *Mounter) MountDev(deviceOpts []string, console string) error {
+	devices := append([]Device{}, DefaultDevices...)
+	for _, opt := range deviceOpts {
+		dev, err := parseDeviceOption(opt)
+		if err != nil {
+			return err
+		}
+		devices = append(devices, dev)
+	}
+
+	devDir, err := m.resolve("/dev")
+	if err != nil {
+		return err
+	}
+	if err := fileutils.CreateIfNotExists(devDir, true); err != nil {
+		return err
+	}
+	if err := osutil.MountIfNotMounted("tmpfs", devDir, "tmpfs", "nosuid,strictatime,mode=755,size=65536k"); err != nil {
+		return errors.Wrapf(err, "Failed to mount /dev")
+	}
+
+	for _, dev := range devices {
+		if err := m.createDevice(dev); err != nil {
+			return errors.Wrapf(err, "Failed to create device %s", dev.Path)
+		}
+	}
+	for _, l := range devSymlinks {
+		// The symlink itself is not followed, but /dev is already resolved.
+		if err := osutil.Symlink(l[0], fp.Join(devDir, fp.Base(l[1]))); err != nil {
+			return err
+		}
+	}
+
+	ptsDir, err := m.resolve("/dev/pts")
+	if err != nil {
+		return err
+	}
+	if err := fileutils.CreateIfNotExists(ptsDir, true); err != nil {
+		return err
+	}
+	// A new instance of devpts keeps the terminals of the host out of the container.
+	if err := osutil.MountIfNotMounted("devpts", ptsDir, "devpts", "nosuid,noexec,newinstance,ptmxmode=0666,mode=0620,gid=5"); err != nil {
+		return errors.Wrapf(err, "Failed to mount /dev/pts")
+	}
+	shmDir, err := m.resolve("/dev/shm")
+	if err != nil {
+		return err
+	}
+	if err := fileutils.CreateIfNotExists(shmDir, true); err != nil {
+		return err
+	}
+	if err := osutil.MountIfNotMounted("shm", shmDir, "tmpfs", "nosuid,noexec,nodev,mode=1777,size=65536k"); err != nil {
+		return errors.Wrapf(err, "Failed to mount /dev/shm")
+	}
+
+	if console != "" {
+		if err := m.mountConsole(console); err != nil {
+			return errors.Wrapf(err, "Failed to mount /dev/console")
+		}
+	}
+	return nil
+}
+
+func (m *Mounter) createDevice(dev Device) error {
+	path, err := m.resolve(dev.Path)
+	if err != nil {
+		return err
+	}
+	if err := fileutils.CreateIfNotExists(fp.Dir(path), true); err != nil {
+		return err
+	}
+	if err := osutil.Mknod(path, dev.Type|uint32(dev.Mode), osutil.Mkdev(dev.Major, dev.Minor)); err != nil {
+		return err
+	}
+	// The mode given to mknod(2) is masked by the umask of droot.
+	if err := os.Chmod(path, dev.Mode); err != nil {
+		return err
+	}
+	return os.Lchown(path, dev.Uid, dev.Gid)
+}
+
+// mountConsole bind mounts the terminal console on /dev/console. The console of a previous run
+// is replaced, since its terminal is likely gone.
+func (m *Mounter) mountConsole(console string) error {
+	path, err := m.resolve("/dev/console")
+	if err != nil {
+		return err
+	}
+	if err := fileutils.CreateIfNotExists(path, false); err != nil {
+		return err
+	}
+	mounted, err := mount.Mounted(path)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if err := mount.Unmount(path); err != nil {
+			return err
+		}
+	}
+	return osutil.ForceMount(console, path, "none", "bind")
+}
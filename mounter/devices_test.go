@@ -0,0 +1,179 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/kylelemons/godebug/pretty"
+	"golang.org/x/sys/unix"
+
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+func TestDefaultDevices(t *testing.T) {
+	expected := map[string][2]int64{
+		"/dev/null":    {1, 3},
+		"/dev/zero":    {1, 5},
+		"/dev/full":    {1, 7},
+		"/dev/random":  {1, 8},
+		"/dev/urandom": {1, 9},
+		"/dev/tty":     {5, 0},
+	}
+	got := map[string][2]int64{}
+	for _, dev := range DefaultDevices {
+		if dev.Type != unix.S_IFCHR || dev.Mode != 0666 {
+			t.Errorf("%s should be a character device of mode 0666", dev.Path)
+		}
+		got[dev.Path] = [2]int64{dev.Major, dev.Minor}
+	}
+	if diff := pretty.Compare(got, expected); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestParseDeviceOption(t *testing.T) {
+	null := Device{Path: "/dev/null", Type: unix.S_IFCHR, Major: 1, Minor: 3, Mode: 0666}
+	cases := []struct {
+		opt    string
+		path   string
+		mode   os.FileMode
+		hasErr bool
+	}{
+		{"/dev/null", "/dev/null", 0666, false},
+		{"/dev/null:/dev/nothing", "/dev/nothing", 0666, false},
+		{"/dev/null:r", "/dev/null", 0444, false},
+		{"/dev/null:/dev/nothing:wm", "/dev/nothing", 0222, false},
+		{"/dev/null:/dev/nothing:rwx", "", 0, true},
+		{"/dev/null:dev/nothing", "", 0, true},
+		{"dev/null", "", 0, true},
+		{"/dev/notexist", "", 0, true},
+		{os.TempDir(), "", 0, true},
+	}
+	for _, c := range cases {
+		dev, err := parseDeviceOption(c.opt)
+		if c.hasErr {
+			if err == nil {
+				t.Errorf("%s should be error", c.opt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s should not be error: %v", c.opt, err)
+			continue
+		}
+		expected := null
+		expected.Path, expected.Mode = c.path, c.mode
+		if diff := pretty.Compare(dev, expected); diff != "" {
+			t.Errorf("%s diff: (-actual +expected)\n%s", c.opt, diff)
+		}
+	}
+}
+
+func TestMountDev(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	rootDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	tty, err := ioutil.TempFile("", "droot-tty")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	tty.Close()
+	defer os.Remove(tty.Name())
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	// A /dev mounted already is reused rather than mounted again.
+	for i := 0; i < 2; i++ {
+		if err := m.MountDev([]string{"/dev/null:/dev/nothing:r"}, tty.Name()); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+
+	devices := append(DefaultDevices, Device{Path: "/dev/nothing", Major: 1, Minor: 3, Mode: 0444})
+	for _, dev := range devices {
+		fi, err := os.Stat(fp.Join(rootDir, dev.Path))
+		if err != nil {
+			t.Errorf("should not be error: %v", err)
+			continue
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if major, minor := osutil.Major(uint64(st.Rdev)), osutil.Minor(uint64(st.Rdev)); major != dev.Major || minor != dev.Minor {
+			t.Errorf("%s: expected %d,%d, got %d,%d", dev.Path, dev.Major, dev.Minor, major, minor)
+		}
+		if fi.Mode()&os.ModeCharDevice == 0 || fi.Mode().Perm() != dev.Mode {
+			t.Errorf("%s: expected a character device of mode %v, got %v", dev.Path, dev.Mode, fi.Mode())
+		}
+	}
+	for _, l := range devSymlinks {
+		if target, err := os.Readlink(fp.Join(rootDir, l[1])); err != nil || target != l[0] {
+			t.Errorf("%s should be a symlink to %s: %s, %v", l[1], l[0], target, err)
+		}
+	}
+
+	var dirs []string
+	mounts, err := m.getMountsRoot()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	for _, mo := range mounts {
+		dirs = append(dirs, mo.Mountpoint[len(rootDir):])
+	}
+	if diff := pretty.Compare(dirs, []string{"/dev", "/dev/pts", "/dev/shm", "/dev/console"}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+	if mounted, err := mount.Mounted(fp.Join(rootDir, "/dev/console")); err != nil || !mounted {
+		t.Errorf("/dev/console should be mounted: %v", err)
+	}
+}
+
+func TestMountDevSymlinks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir, victim := fp.Join(tmpDir, "root"), fp.Join(tmpDir, "victim")
+	for _, dir := range []string{rootDir, victim} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	// Symlinks of the image pointing out of the container.
+	if err := os.Symlink("../victim", fp.Join(rootDir, "dev")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Symlink(victim, fp.Join(rootDir, "opt")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	if err := m.MountDev([]string{"/dev/null:/opt/null"}, os.DevNull); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	if mounted, err := mount.Mounted(victim); err != nil || mounted {
+		t.Errorf("nothing should be mounted outside of the container: %v", err)
+	}
+	if childs, err := ioutil.ReadDir(victim); err != nil || len(childs) != 0 {
+		t.Errorf("nothing should be created outside of the container: %v", childs)
+	}
+	if mounted, err := mount.Mounted(fp.Join(rootDir, "victim")); err != nil || !mounted {
+		t.Errorf("/dev should be mounted on the target of its symlink in the container: %v", err)
+	}
+	if fi, err := os.Lstat(fp.Join(rootDir, victim, "null")); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		t.Errorf("the device should be created on the target of its symlink in the container: %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/docker/docker/pkg/fileutils"
 	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/symlink"
 	"github.com/pkg/errors"
 
 	"github.com/asmyasnikov/droot/log"
@@ -20,34 +21,85 @@ const DROOT_BINDS_FILE_PATH = ".drootbinds"
 
 type Mounter struct {
 	rootDir string
+	binds   []Bind
+	tmpfs   []string
+}
+
+// Bind is a file or directory of the host bind mounted in the container.
+type Bind struct {
+	HostDir      string
+	ContainerDir string
+	RW           bool
+	Recursive    bool     // rbind, which binds the mounts beneath HostDir too, rather than bind
+	Flags        []string // nosuid, nodev and noexec
+	Propagation  string   // shared, slave or private, or their recursive forms, if set
+	Create       string   // dir, file or none: what ContainerDir is created as, if missing (default: the kind of HostDir)
 }
 
 func NewMounter(rootDir string) *Mounter {
 	return &Mounter{rootDir: rootDir}
 }
 
-func parseBindOption(bindOption string) (hostDir string, containerDir string, rw bool, err error) {
+// parseBindOption parses SRC-PATH[:DEST-PATH][:OPTIONS] of --bind and DROOT_BINDS_FILE_PATH, whose options are
+// separated by commas as in `docker run --volume`: ro or rw, nosuid, nodev, noexec, the propagation shared,
+// slave or private and their recursive forms, create=dir|file|none, and bind or rbind (the default).
+func parseBindOption(bindOption string) (Bind, error) {
+	b := Bind{RW: true, Recursive: true}
 	d := strings.SplitN(bindOption, ":", 3)
+	var options string
 	switch len(d) {
 	case 3:
-		hostDir, containerDir = d[0], d[1]
-		rw = strings.ToLower(d[2]) != "rw"
+		b.HostDir, b.ContainerDir, options = d[0], d[1], d[2]
 	case 2:
-		hostDir, containerDir = d[0], d[1]
-		rw = true
-	case 1:
-		hostDir, containerDir = d[0], d[0]
-		rw = true
+		// The second field is the options unless it is a path.
+		if fp.IsAbs(d[1]) {
+			b.HostDir, b.ContainerDir = d[0], d[1]
+		} else {
+			b.HostDir, b.ContainerDir, options = d[0], d[0], d[1]
+		}
 	default:
-		return hostDir, containerDir, rw, fmt.Errorf("Unknown bind option '%s'", bindOption)
+		b.HostDir, b.ContainerDir = d[0], d[0]
 	}
-	if !fp.IsAbs(hostDir) {
-		return hostDir, containerDir, rw, fmt.Errorf("%s is not an absolute path", hostDir)
+	if !fp.IsAbs(b.HostDir) {
+		return b, fmt.Errorf("%s is not an absolute path", b.HostDir)
 	}
-	if !fp.IsAbs(containerDir) {
-		return hostDir, containerDir, rw, fmt.Errorf("%s is not an absolute path", containerDir)
+	if !fp.IsAbs(b.ContainerDir) {
+		return b, fmt.Errorf("%s is not an absolute path", b.ContainerDir)
+	}
+	b.HostDir, b.ContainerDir = fp.Clean(b.HostDir), fp.Clean(b.ContainerDir)
+
+	seen := map[string]bool{}
+	for _, opt := range strings.Split(options, ",") {
+		key := opt
+		switch {
+		case opt == "":
+			continue
+		case opt == "ro" || opt == "rw":
+			key, b.RW = "ro/rw", opt == "rw"
+		case opt == "nosuid" || opt == "nodev" || opt == "noexec":
+			b.Flags = append(b.Flags, opt)
+		case propagations[opt]:
+			key, b.Propagation = "propagation", opt
+		case strings.HasPrefix(opt, "create="):
+			key, b.Create = "create", strings.TrimPrefix(opt, "create=")
+			if b.Create != "dir" && b.Create != "file" && b.Create != "none" {
+				return b, fmt.Errorf("Unknown bind option '%s' of %s, which should be create=dir|file|none", opt, bindOption)
+			}
+		case opt == "bind" || opt == "rbind":
+			key, b.Recursive = "bind/rbind", opt == "rbind"
+		default:
+			return b, fmt.Errorf("Unknown bind option '%s' of %s", opt, bindOption)
+		}
+		if seen[key] {
+			return b, fmt.Errorf("Duplicate bind option '%s' of %s", opt, bindOption)
+		}
+		seen[key] = true
 	}
-	return fp.Clean(hostDir), fp.Clean(containerDir), rw, nil
+	return b, nil
+}
+
+var propagations = map[string]bool{
+	"shared": true, "rshared": true, "slave": true, "rslave": true, "private": true, "rprivate": true,
 }
 
 func ResolveRootDir(dir string) (string, error) {
@@ -72,27 +124,250 @@ func ResolveRootDir(dir string) (string, error) {
 	return dir, nil
 }
 
-func (m *Mounter) MountSysProc() error {
+// resolve returns the path of containerPath in the root directory. Symlinks of the container
+// are followed as if the root directory were "/", so that a symlink of the image, such as
+// /tmp -> /etc, can not make droot create or mount anything outside of the container.
+func (m *Mounter) resolve(containerPath string) (string, error) {
+	path, err := symlink.FollowSymlinkInScope(fp.Join(m.rootDir, containerPath), m.rootDir)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to resolve %s in the container", containerPath)
+	}
+	return path, nil
+}
+
+// MountSysProc mounts /proc and /sys of the container. A new /proc is mounted over
+// the one of the container, if mounted already, for a new PID namespace.
+func (m *Mounter) MountSysProc(newProc bool) error {
+	procDir, err := m.resolve("/proc")
+	if err != nil {
+		return err
+	}
+	sysDir, err := m.resolve("/sys")
+	if err != nil {
+		return err
+	}
 	// mount -t proc proc {{rootDir}}/proc
-	if err := osutil.MountIfNotMounted("proc", fp.Join(m.rootDir, "/proc"), "proc", ""); err != nil {
+	mountProc := osutil.MountIfNotMounted
+	if newProc {
+		mountProc = osutil.ForceMount
+	}
+	if err := mountProc("proc", procDir, "proc", ""); err != nil {
 		return errors.Errorf("Failed to mount /proc: %s", err)
 	}
 	// mount --rbind /sys {{rootDir}}/sys
-	if err := osutil.MountIfNotMounted("/sys", fp.Join(m.rootDir, "/sys"), "none", "rbind"); err != nil {
+	if err := osutil.MountIfNotMounted("/sys", sysDir, "none", "rbind"); err != nil {
 		return errors.Errorf("Failed to mount /sys: %s", err)
 	}
 	// mount --make-rslave /sys {{rootDir}}/sys
-	if err := osutil.ForceMount("", fp.Join(m.rootDir, "/sys"), "none", "rslave"); err != nil {
+	if err := osutil.ForceMount("", sysDir, "none", "rslave"); err != nil {
 		return errors.Errorf("Failed to mount --make-rslave /sys: %s", err)
 	}
 
 	return nil
 }
 
-func containerBinds(path string) (binds []string, err error) {
-	if !osutil.ExistsFile(path) {
-		return binds, nil
+// DefaultMaskedPaths are the paths of the container hidden from the command by default, as in Docker.
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// DefaultReadonlyPaths are the paths of the container read-only by default, as in Docker.
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// MaskPaths hides paths of the container: an empty read-only tmpfs is mounted on directories,
+// and /dev/null on files. Paths which do not exist, or are hidden already, are skipped.
+func (m *Mounter) MaskPaths(paths []string) error {
+	null, err := os.Stat(os.DevNull)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		target, err := m.resolve(path)
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if osutil.IsTmpfs(target) {
+				continue
+			}
+			err = osutil.ForceMount("tmpfs", target, "tmpfs", "ro,nosuid,nodev,noexec")
+		} else {
+			if os.SameFile(fi, null) {
+				continue
+			}
+			err = osutil.ForceMount(os.DevNull, target, "none", "bind")
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to mask %s", path)
+		}
+	}
+	return nil
+}
+
+// ReadonlyPaths makes paths of the container, and the mounts beneath them, read-only.
+// Paths which do not exist, or are read-only already, are skipped.
+func (m *Mounter) ReadonlyPaths(paths []string) error {
+	for _, path := range paths {
+		target, err := m.resolve(path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			continue
+		}
+		if osutil.IsReadonly(target) {
+			continue
+		}
+		// Only a mount point can be remounted read-only, so the path is bind mounted on itself.
+		if err := osutil.ForceMount(target, target, "none", "rbind"); err != nil {
+			return errors.Wrapf(err, "Failed to bind mount %s", path)
+		}
+		if err := remountReadonly(target); err != nil {
+			return errors.Wrapf(err, "Failed to remount %s read-only", path)
+		}
+	}
+	return nil
+}
+
+// remountReadonly remounts the mount at dir and the mounts beneath it read-only, keeping their other flags.
+// They are bind remounted, which changes them but not the filesystems they mount.
+func remountReadonly(dir string) error {
+	mounts, err := mountTree(dir)
+	if err != nil {
+		return err
+	}
+	for _, mo := range mounts {
+		if osutil.IsReadonly(mo.Mountpoint) {
+			continue
+		}
+		if err := remountBind(mo, []string{"ro"}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remountBind bind remounts the mount mo with flags, keeping its other flags.
+func remountBind(mo *mount.Info, flags []string) error {
+	return osutil.RemountBind(mo.Mountpoint, append(append([]string{}, flags...), strings.Split(mo.Opts, ",")...))
+}
+
+// mountTree returns the mount at dir, the last one mounted on it, followed by the mounts beneath it.
+func mountTree(dir string) ([]*mount.Info, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	var tree []*mount.Info
+	ids := map[int]bool{}
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].Mountpoint == dir {
+			tree = append(tree, mounts[i])
+			ids[mounts[i].ID] = true
+			break
+		}
+	}
+	if len(tree) == 0 {
+		return nil, fmt.Errorf("%s is not a mount point", dir)
+	}
+	// Mounts are listed after their parents.
+	for _, mo := range mounts {
+		if ids[mo.Parent] && !ids[mo.ID] {
+			tree = append(tree, mo)
+			ids[mo.ID] = true
+		}
+	}
+	return tree, nil
+}
+
+// parseTmpfsOption parses DEST-PATH[:OPTIONS] of --tmpfs, whose options are the ones of tmpfs
+// and of mount(8), e.g. size=64m,mode=1777. Like Docker, tmpfs are noexec, nosuid and nodev by default.
+func parseTmpfsOption(tmpfsOption string) (containerDir string, options string, err error) {
+	d := strings.SplitN(tmpfsOption, ":", 2)
+	containerDir, options = d[0], "noexec,nosuid,nodev"
+	if len(d) == 2 && d[1] != "" {
+		options += "," + d[1]
+	}
+	if !fp.IsAbs(containerDir) {
+		return containerDir, options, fmt.Errorf("%s is not an absolute path", containerDir)
+	}
+	return fp.Clean(containerDir), options, nil
+}
+
+// TmpfsMounts mounts a tmpfs on each container directory of tmpfsOpts.
+// A directory mounted already, by a previous run without a mount namespace, is kept.
+func (m *Mounter) TmpfsMounts(tmpfsOpts []string) error {
+	for _, tmpfsOption := range tmpfsOpts {
+		containerDir, options, err := parseTmpfsOption(tmpfsOption)
+		if err != nil {
+			return err
+		}
+		target, err := m.resolve(containerDir)
+		if err != nil {
+			return err
+		}
+		if err := fileutils.CreateIfNotExists(target, true); err != nil { // mkdir -p
+			return err
+		}
+		if err := osutil.MountIfNotMounted("tmpfs", target, "tmpfs", options); err != nil {
+			return errors.Wrapf(err, "Failed to mount tmpfs %s", tmpfsOption)
+		}
+		m.tmpfs = append(m.tmpfs, containerDir)
+	}
+	return nil
+}
+
+// Tmpfs returns the container directories of the tmpfs mounted by TmpfsMounts.
+func (m *Mounter) Tmpfs() []string {
+	return m.tmpfs
+}
+
+// MountRootReadonly makes the root directory of the container read-only, but not the mounts beneath it,
+// such as /proc, /dev, binds and tmpfs. The root directory is bind mounted on itself, which UmountRoot
+// unmounts, so that the filesystem of the container is left writable for droot.
+func (m *Mounter) MountRootReadonly() error {
+	if osutil.IsReadonly(m.rootDir) {
+		return nil
 	}
+	if err := osutil.ForceMount(m.rootDir, m.rootDir, "none", "rbind"); err != nil {
+		return errors.Wrapf(err, "Failed to bind mount %s", m.rootDir)
+	}
+	mounts, err := mountTree(m.rootDir)
+	if err != nil {
+		return err
+	}
+	if err := remountBind(mounts[0], []string{"ro"}); err != nil {
+		return errors.Wrapf(err, "Failed to remount %s read-only", m.rootDir)
+	}
+	return nil
+}
+
+// ReadBindsFile reads the bind options of DROOT_BINDS_FILE_PATH.
+func ReadBindsFile(path string) (binds []string, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -109,60 +384,94 @@ func containerBinds(path string) (binds []string, err error) {
 	return binds, nil
 }
 
-func (m *Mounter) BindMounts(bindOpts []string, path string) error {
-	binds, err := containerBinds(path)
-	if err != nil {
-		return err
-	}
-	for _, bindOption := range append(binds, bindOpts...) {
-		hostDir, containerDir, rw, err := parseBindOption(bindOption)
+func (m *Mounter) BindMounts(bindOpts []string) error {
+	for _, bindOption := range bindOpts {
+		b, err := parseBindOption(bindOption)
 		if err != nil {
 			return err
 		}
-		if rw {
-			if err := m.bindMount(hostDir, containerDir); err != nil {
-				return errors.Wrapf(err, "Failed to bind read-write mount point %s", bindOpts)
-			}
-		} else {
-			if err := m.roBindMount(hostDir, containerDir); err != nil {
-				return errors.Wrapf(err, "Failed to bind read-only mount point %s", bindOpts)
-			}
+		if err := m.bindMount(b); err != nil {
+			return errors.Wrapf(err, "Failed to bind mount %s", bindOption)
 		}
+		m.binds = append(m.binds, b)
 	}
 	return nil
 }
 
-func (m *Mounter) bindMount(hostDir, containerDir string) error {
-	containerDir = fp.Join(m.rootDir, containerDir)
-
-	if ok := osutil.IsDirEmpty(hostDir); ok {
-		if _, err := os.Create(fp.Join(hostDir, ".droot.keep")); err != nil {
-			return err
-		}
-	}
+// Binds returns the binds mounted by BindMounts.
+func (m *Mounter) Binds() []Bind {
+	return m.binds
+}
 
-	if err := fileutils.CreateIfNotExists(containerDir, true); err != nil { // mkdir -p
+// bindMount bind mounts b. A container directory mounted already, such as by a previous run
+// without a mount namespace, is mounted again, so that the options of b apply rather than old ones.
+func (m *Mounter) bindMount(b Bind) error {
+	containerDir, err := m.resolve(b.ContainerDir)
+	if err != nil {
 		return err
 	}
 
-	if err := osutil.MountIfNotMounted(hostDir, containerDir, "none", "bind,rw"); err != nil {
+	fi, err := os.Stat(b.HostDir)
+	if err != nil {
 		return err
 	}
+	switch create := b.Create; {
+	case create == "none":
+		if _, err := os.Stat(containerDir); err != nil {
+			return err
+		}
+	case create == "dir" || (create == "" && fi.IsDir()):
+		if err := fileutils.CreateIfNotExists(containerDir, true); err != nil { // mkdir -p
+			return err
+		}
+	default:
+		if err := fileutils.CreateIfNotExists(containerDir, false); err != nil { // touch
+			return err
+		}
+	}
 
-	return nil
-}
-
-func (m *Mounter) roBindMount(hostDir, containerDir string) error {
-	if err := m.bindMount(hostDir, containerDir); err != nil {
+	mounted, err := mount.Mounted(containerDir)
+	if err != nil {
 		return err
 	}
-
-	containerDir = fp.Join(m.rootDir, containerDir)
-
-	if err := osutil.ForceMount(hostDir, containerDir, "none", "remount,ro,bind"); err != nil {
+	if mounted {
+		if err := mount.Unmount(containerDir); err != nil {
+			return errors.Wrapf(err, "Failed to umount %s mounted already", containerDir)
+		}
+		log.Debug("umount:", containerDir)
+	}
+	bind := "bind"
+	if b.Recursive {
+		bind = "rbind"
+	}
+	if err := osutil.ForceMount(b.HostDir, containerDir, "none", bind); err != nil {
 		return err
 	}
 
+	// The flags of a bind mount can only be changed by remounting it.
+	flags := b.Flags
+	if !b.RW {
+		flags = append([]string{"ro"}, flags...)
+	}
+	if len(flags) > 0 {
+		mounts, err := mountTree(containerDir)
+		if err != nil {
+			return err
+		}
+		if !b.Recursive {
+			mounts = mounts[:1]
+		}
+		for _, mo := range mounts {
+			if err := remountBind(mo, flags); err != nil {
+				return err
+			}
+		}
+	}
+	if b.Propagation != "" {
+		if err := osutil.ForceMount("", containerDir, "none", b.Propagation); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -174,7 +483,7 @@ func (m *Mounter) getMountsRoot() ([]*mount.Info, error) {
 
 	targets := make([]*mount.Info, 0)
 	for _, mo := range mounts {
-		if strings.HasPrefix(mo.Mountpoint, m.rootDir) {
+		if mo.Mountpoint == m.rootDir || strings.HasPrefix(mo.Mountpoint, m.rootDir+"/") {
 			targets = append(targets, mo)
 		}
 	}
@@ -182,15 +491,43 @@ func (m *Mounter) getMountsRoot() ([]*mount.Info, error) {
 	return targets, nil
 }
 
+// UmountBinds unmounts the container directories of bindOpts in reverse order,
+// so that nested mount points are unmounted before their parents.
+func (m *Mounter) UmountBinds(bindOpts []string) error {
+	for i := len(bindOpts) - 1; i >= 0; i-- {
+		b, err := parseBindOption(bindOpts[i])
+		if err != nil {
+			return err
+		}
+		containerDir, err := m.resolve(b.ContainerDir)
+		if err != nil {
+			continue
+		}
+		mounted, err := mount.Mounted(containerDir)
+		if err != nil || !mounted {
+			continue
+		}
+		if err := mount.Unmount(containerDir); err != nil {
+			return errors.Wrapf(err, "Failed to umount %s", containerDir)
+		}
+		log.Debug("umount:", containerDir)
+	}
+	return nil
+}
+
+// UmountRoot unmounts the mounts of the container, the read-only root directory of --read-only included.
+// They are unmounted in the reverse order they were mounted, so that mounts on top of others,
+// nested ones or ones stacked on the same directory, are unmounted first.
 func (m *Mounter) UmountRoot() error {
 	mounts, err := m.getMountsRoot()
 	if err != nil {
 		return err
 	}
 
-	for _, mo := range mounts {
+	for i := len(mounts) - 1; i >= 0; i-- {
+		mo := mounts[i]
 		if err := mount.Unmount(mo.Mountpoint); err != nil {
-			return err
+			return errors.Wrapf(err, "Failed to umount %s", mo.Mountpoint)
 		}
 		log.Debug("umount:", mo.Mountpoint)
 	}
@@ -1,7 +1,16 @@
 package mounter
 
 import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/kylelemons/godebug/pretty"
+
+	"github.com/asmyasnikov/droot/osutil"
 )
 
 func TestResolveRootDir(t *testing.T) {
@@ -15,3 +24,421 @@ func TestResolveRootDir(t *testing.T) {
 		t.Errorf("should not be error: %v", err)
 	}
 }
+
+func TestMaskPathsAndReadonlyPaths(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	rootDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	for _, dir := range []string{"/proc/acpi", "/proc/sys"} {
+		if err := os.MkdirAll(fp.Join(rootDir, dir), 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(fp.Join(rootDir, "/proc/kcore"), []byte("core"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	// Masking and making read-only twice must not stack mounts.
+	for i := 0; i < 2; i++ {
+		if err := m.MaskPaths(DefaultMaskedPaths); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if err := m.ReadonlyPaths(DefaultReadonlyPaths); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+
+	null, err := os.Stat(os.DevNull)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if fi, err := os.Stat(fp.Join(rootDir, "/proc/kcore")); err != nil || !os.SameFile(fi, null) {
+		t.Errorf("/proc/kcore should be masked by %s: %v", os.DevNull, err)
+	}
+	if !osutil.IsTmpfs(fp.Join(rootDir, "/proc/acpi")) {
+		t.Error("/proc/acpi should be masked by a tmpfs")
+	}
+	if !osutil.IsReadonly(fp.Join(rootDir, "/proc/sys")) {
+		t.Error("/proc/sys should be read-only")
+	}
+	if osutil.IsReadonly(rootDir) {
+		t.Error("the root directory should not be read-only")
+	}
+	mounts, err := m.getMountsRoot()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(mounts) != 3 {
+		t.Errorf("expected 3 mounts, got %d", len(mounts))
+	}
+}
+
+func TestMaskPathsAndReadonlyPathsSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir, victim := fp.Join(tmpDir, "root"), fp.Join(tmpDir, "victim")
+	for _, dir := range []string{fp.Join(rootDir, "proc"), victim} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	// Symlinks of the image pointing out of the container.
+	if err := os.Symlink(victim, fp.Join(rootDir, "/proc/acpi")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Symlink("../../victim", fp.Join(rootDir, "/proc/sys")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	if err := m.MaskPaths([]string{"/proc/acpi"}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := m.ReadonlyPaths([]string{"/proc/sys"}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if osutil.IsTmpfs(victim) || osutil.IsReadonly(victim) {
+		t.Error("nothing outside of the container should be masked or made read-only")
+	}
+}
+
+func TestParseTmpfsOption(t *testing.T) {
+	cases := []struct {
+		opt          string
+		containerDir string
+		options      string
+		hasErr       bool
+	}{
+		{"/tmp", "/tmp", "noexec,nosuid,nodev", false},
+		{"/tmp/:size=64m,mode=1777", "/tmp", "noexec,nosuid,nodev,size=64m,mode=1777", false},
+		{"/run:exec", "/run", "noexec,nosuid,nodev,exec", false},
+		{"tmp:size=64m", "", "", true},
+	}
+	for _, c := range cases {
+		containerDir, options, err := parseTmpfsOption(c.opt)
+		if c.hasErr {
+			if err == nil {
+				t.Errorf("%s should be error", c.opt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s should not be error: %v", c.opt, err)
+			continue
+		}
+		if containerDir != c.containerDir || options != c.options {
+			t.Errorf("%s: expected %s %s, got %s %s", c.opt, c.containerDir, c.options, containerDir, options)
+		}
+	}
+}
+
+func TestMountRootReadonly(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	rootDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	// A directory whose path starts with the root directory is not part of the container.
+	other := rootDir + "-other"
+	if err := os.Mkdir(other, 0755); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(other)
+	if err := osutil.ForceMount("tmpfs", other, "tmpfs", ""); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer NewMounter(other).UmountRoot()
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	if err := m.TmpfsMounts([]string{"/tmp:size=1m,mode=1777"}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.MountRootReadonly(); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if !osutil.IsReadonly(rootDir) {
+		t.Error("the root directory should be read-only")
+	}
+	if err := ioutil.WriteFile(fp.Join(rootDir, "/tmp/file"), []byte("x"), 0644); err != nil {
+		t.Errorf("tmpfs should be writable: %v", err)
+	}
+	if fi, err := os.Stat(fp.Join(rootDir, "/tmp")); err != nil || fi.Mode().Perm()|fi.Mode()&os.ModeSticky != 0777|os.ModeSticky {
+		t.Errorf("tmpfs should be of mode 1777: %v", err)
+	}
+
+	if err := m.UmountRoot(); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	mounts, err := m.getMountsRoot()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Errorf("expected no mounts, got %d", len(mounts))
+	}
+	if osutil.IsReadonly(rootDir) {
+		t.Error("the root directory should be writable after UmountRoot")
+	}
+	if !osutil.IsTmpfs(other) {
+		t.Errorf("%s should not be unmounted", other)
+	}
+}
+
+func TestTmpfsMountsSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir, victim := fp.Join(tmpDir, "root"), fp.Join(tmpDir, "victim")
+	for _, dir := range []string{rootDir, victim} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	// A symlink of the image pointing out of the container.
+	if err := os.Symlink("../../victim", fp.Join(rootDir, "tmp")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	if err := m.TmpfsMounts([]string{"/tmp"}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if osutil.IsTmpfs(victim) {
+		t.Error("nothing should be mounted outside of the container")
+	}
+	if !osutil.IsTmpfs(fp.Join(rootDir, "victim")) {
+		t.Error("tmpfs should be mounted on the target of the symlink in the container")
+	}
+}
+
+func TestParseBindOption(t *testing.T) {
+	cases := []struct {
+		opt    string
+		bind   Bind
+		hasErr bool
+	}{
+		{"/var/log", Bind{HostDir: "/var/log", ContainerDir: "/var/log", RW: true, Recursive: true}, false},
+		{"/var/log/app/:/var/log", Bind{HostDir: "/var/log/app", ContainerDir: "/var/log", RW: true, Recursive: true}, false},
+		{"/var/log/app:/var/log:ro", Bind{HostDir: "/var/log/app", ContainerDir: "/var/log", Recursive: true}, false},
+		{"/var/log/app:/var/log:rw", Bind{HostDir: "/var/log/app", ContainerDir: "/var/log", RW: true, Recursive: true}, false},
+		{"/etc/app.conf:ro,create=file", Bind{HostDir: "/etc/app.conf", ContainerDir: "/etc/app.conf", Recursive: true, Create: "file"}, false},
+		{
+			"/data:/data:nosuid,nodev,noexec,rslave,bind,create=none",
+			Bind{HostDir: "/data", ContainerDir: "/data", RW: true, Flags: []string{"nosuid", "nodev", "noexec"}, Propagation: "rslave", Create: "none"},
+			false,
+		},
+		{"/data:/data:ro,rw", Bind{}, true},
+		{"/data:/data:shared,private", Bind{}, true},
+		{"/data:/data:create=socket", Bind{}, true},
+		{"/data:/data:z", Bind{}, true},
+		{"/data:data", Bind{}, true},
+		{"data:/data", Bind{}, true},
+	}
+	for _, c := range cases {
+		b, err := parseBindOption(c.opt)
+		if c.hasErr {
+			if err == nil {
+				t.Errorf("%s should be error", c.opt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s should not be error: %v", c.opt, err)
+			continue
+		}
+		if diff := pretty.Compare(b, c.bind); diff != "" {
+			t.Errorf("%s diff: (-actual +expected)\n%s", c.opt, diff)
+		}
+	}
+}
+
+func TestBindMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir, hostDir := fp.Join(tmpDir, "root"), fp.Join(tmpDir, "host")
+	for _, dir := range []string{rootDir, fp.Join(hostDir, "empty"), fp.Join(hostDir, "sub")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(fp.Join(hostDir, "app.conf"), []byte("conf"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// A mount beneath the host directory, which only rbind binds too.
+	if err := osutil.ForceMount("tmpfs", fp.Join(hostDir, "sub"), "tmpfs", ""); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer NewMounter(hostDir).UmountRoot()
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	binds := []string{
+		hostDir + "/app.conf:/etc/app.conf:ro",
+		hostDir + ":/rbind:nosuid,noexec",
+		hostDir + ":/bind:bind,ro",
+		hostDir + "/empty:/shared:shared",
+	}
+	if err := m.BindMounts(binds); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(m.Binds()) != len(binds) {
+		t.Errorf("expected %d binds, got %d", len(binds), len(m.Binds()))
+	}
+
+	if b, err := ioutil.ReadFile(fp.Join(rootDir, "/etc/app.conf")); err != nil || string(b) != "conf" {
+		t.Errorf("a file should be bind mounted: %s, %v", b, err)
+	}
+	if err := ioutil.WriteFile(fp.Join(rootDir, "/etc/app.conf"), []byte("x"), 0644); err == nil {
+		t.Error("a read-only bind should not be writable")
+	}
+	if !osutil.IsTmpfs(fp.Join(rootDir, "/rbind/sub")) {
+		t.Error("rbind should bind the mounts beneath the host directory")
+	}
+	if osutil.IsTmpfs(fp.Join(rootDir, "/bind/sub")) {
+		t.Error("bind should not bind the mounts beneath the host directory")
+	}
+	if !osutil.IsReadonly(fp.Join(rootDir, "/bind")) || osutil.IsReadonly(fp.Join(rootDir, "/rbind")) {
+		t.Error("only the read-only bind should be read-only")
+	}
+	if osutil.ExistsFile(fp.Join(hostDir, "empty", ".droot.keep")) {
+		t.Error("nothing should be created in the host directory")
+	}
+
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	opts := map[string]string{}
+	for _, mo := range mounts {
+		opts[mo.Mountpoint] = mo.Opts + " " + mo.Optional
+	}
+	for dir, expected := range map[string][]string{
+		"/rbind":     {"nosuid", "noexec"},
+		"/rbind/sub": {"nosuid", "noexec"},
+		"/shared":    {"shared:"},
+	} {
+		for _, e := range expected {
+			if !strings.Contains(opts[fp.Join(rootDir, dir)], e) {
+				t.Errorf("%s should be %s: %s", dir, e, opts[fp.Join(rootDir, dir)])
+			}
+		}
+	}
+
+	if err := m.BindMounts([]string{hostDir + ":/none:create=none"}); err == nil {
+		t.Error("a missing container directory of create=none should be error")
+	}
+
+	// A bind left mounted by a previous run takes the options of the new one.
+	for _, ro := range []bool{true, false} {
+		opt := hostDir + ":/rbind"
+		if ro {
+			opt += ":ro"
+		}
+		if err := NewMounter(rootDir).BindMounts([]string{opt}); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if osutil.IsReadonly(fp.Join(rootDir, "/rbind")) != ro {
+			t.Errorf("%s should be read-only: %v", opt, ro)
+		}
+	}
+	if mounts, err = mount.GetMounts(); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	n := 0
+	for _, mo := range mounts {
+		if mo.Mountpoint == fp.Join(rootDir, "/rbind") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("/rbind should be mounted once, not stacked: %d", n)
+	}
+}
+
+func TestBindMountsSymlink(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-mounter")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootDir, hostDir, victim := fp.Join(tmpDir, "root"), fp.Join(tmpDir, "host"), fp.Join(tmpDir, "victim")
+	for _, dir := range []string{rootDir, hostDir, victim} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(fp.Join(hostDir, "app.conf"), []byte("conf"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// Symlinks of the image pointing out of the container.
+	if err := os.Symlink(victim, fp.Join(rootDir, "data")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Symlink("../../victim", fp.Join(rootDir, "etc")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	m := NewMounter(rootDir)
+	defer m.UmountRoot()
+	binds := []string{hostDir + ":/data", hostDir + "/app.conf:/etc/app.conf:ro"}
+	if err := m.BindMounts(binds); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if mounted, err := mount.Mounted(victim); err != nil || mounted {
+		t.Errorf("nothing should be mounted outside of the container: %v", err)
+	}
+	if childs, err := ioutil.ReadDir(victim); err != nil || len(childs) != 0 {
+		t.Errorf("nothing should be created outside of the container: %v", childs)
+	}
+	for _, dir := range []string{fp.Join(rootDir, victim), fp.Join(rootDir, "victim/app.conf")} {
+		if mounted, err := mount.Mounted(dir); err != nil || !mounted {
+			t.Errorf("%s should be mounted on the target of the symlink in the container: %v", dir, err)
+		}
+	}
+
+	if err := m.UmountBinds(binds); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	mounts, err := m.getMountsRoot()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Errorf("expected no mounts, got %d", len(mounts))
+	}
+}
@@ -0,0 +1,108 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// Overlay is a copy-on-write view of the root directory of a container, mounted with overlayfs.
+// The container is only read, and the changes of a run are written to the upper directory.
+type Overlay struct {
+	LowerDir  string // the root directory of the container
+	UpperDir  string
+	WorkDir   string
+	MergedDir string // the root directory of the run
+
+	dir       string // the directory of the run, which holds the others except a given upper directory
+	keepUpper bool   // whether the upper directory was given, rather than created in dir
+}
+
+// NewOverlay creates the directories of an overlay of lowerDir for a run. Unless upperDir is given,
+// the upper directory is created for the run too. The directory of the run is created next to the
+// upper directory, since overlayfs requires the work directory to be on the same filesystem as it.
+func NewOverlay(lowerDir, upperDir string) (*Overlay, error) {
+	o := &Overlay{LowerDir: lowerDir, UpperDir: upperDir, keepUpper: upperDir != ""}
+	parent := lowerDir
+	if upperDir != "" {
+		if !fp.IsAbs(upperDir) {
+			return nil, errors.Errorf("%s is not an absolute path", upperDir)
+		}
+		o.UpperDir = fp.Clean(upperDir)
+		if err := os.MkdirAll(o.UpperDir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "Failed to create upper directory %s", upperDir)
+		}
+		parent = o.UpperDir
+	}
+
+	dir, err := ioutil.TempDir(fp.Dir(parent), "."+fp.Base(parent)+".droot-overlay-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create overlay directory")
+	}
+	o.dir = dir
+	if o.UpperDir == "" {
+		o.UpperDir = fp.Join(dir, "upper")
+	}
+	o.WorkDir, o.MergedDir = fp.Join(dir, "work"), fp.Join(dir, "merged")
+	for _, d := range []string{o.UpperDir, o.WorkDir, o.MergedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			os.RemoveAll(dir)
+			return nil, errors.Wrapf(err, "Failed to create overlay directory %s", d)
+		}
+	}
+	return o, nil
+}
+
+// Mount mounts the overlay on MergedDir.
+func (o *Overlay) Mount() error {
+	for _, d := range []string{o.LowerDir, o.UpperDir, o.WorkDir} {
+		// They would be taken for separators of the options of overlayfs.
+		if strings.ContainsAny(d, ",:") {
+			return errors.Errorf("Overlay directory %s must not contain ',' or ':'", d)
+		}
+	}
+	options := "lowerdir=" + o.LowerDir + ",upperdir=" + o.UpperDir + ",workdir=" + o.WorkDir
+	if err := osutil.ForceMount("overlay", o.MergedDir, "overlay", options); err != nil {
+		return errors.Wrapf(err, "Failed to mount overlay of %s", o.LowerDir)
+	}
+	return nil
+}
+
+// Remove unmounts the overlay and everything mounted beneath it, and removes the directories of the run.
+// The upper directory is removed too if removeUpper is set. Otherwise, an upper directory created for the
+// run is kept in place, so that its changes can be found.
+func (o *Overlay) Remove(removeUpper bool) error {
+	m := NewMounter(o.MergedDir)
+	if err := m.UmountRoot(); err != nil {
+		return err
+	}
+	// Never remove the directories while anything is still mounted beneath them, such as binds of the host.
+	mounts, err := m.getMountsRoot()
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return errors.Errorf("Failed to remove overlay %s, which is still mounted", o.dir)
+	}
+
+	for _, d := range []string{o.WorkDir, o.MergedDir} {
+		if err := os.RemoveAll(d); err != nil {
+			return errors.Wrapf(err, "Failed to remove %s", d)
+		}
+	}
+	if removeUpper {
+		if err := os.RemoveAll(o.UpperDir); err != nil {
+			return errors.Wrapf(err, "Failed to remove %s", o.UpperDir)
+		}
+	} else if !o.keepUpper {
+		log.Infof("The changes of the run are kept in %s", o.UpperDir)
+		return nil
+	}
+	return os.Remove(o.dir)
+}
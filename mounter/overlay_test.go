@@ -0,0 +1,86 @@
+package mounter
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	tmpDir, err := ioutil.TempDir("", "droot-overlay")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	lowerDir := fp.Join(tmpDir, "root")
+	if err := os.MkdirAll(fp.Join(lowerDir, "etc"), 0755); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := ioutil.WriteFile(fp.Join(lowerDir, "etc/hosts"), []byte("lower"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	run := func(upperDir string, remove bool, shown string) *Overlay {
+		o, err := NewOverlay(lowerDir, upperDir)
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if err := o.Mount(); err != nil {
+			o.Remove(true)
+			t.Fatalf("should not be error: %v", err)
+		}
+		if b, err := ioutil.ReadFile(fp.Join(o.MergedDir, "etc/hosts")); err != nil || string(b) != shown {
+			t.Errorf("the overlay should show %s: %s, %v", shown, b, err)
+		}
+		if err := ioutil.WriteFile(fp.Join(o.MergedDir, "etc/hosts"), []byte("upper"), 0644); err != nil {
+			t.Errorf("should not be error: %v", err)
+		}
+		if err := o.Remove(remove); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if b, err := ioutil.ReadFile(fp.Join(lowerDir, "etc/hosts")); err != nil || string(b) != "lower" {
+			t.Errorf("the lower directory should not be changed: %s, %v", b, err)
+		}
+		if _, err := os.Stat(o.MergedDir); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed: %v", o.MergedDir, err)
+		}
+		return o
+	}
+
+	// The upper directory created for the run is kept with its changes.
+	o := run("", false, "lower")
+	if b, err := ioutil.ReadFile(fp.Join(o.UpperDir, "etc/hosts")); err != nil || string(b) != "upper" {
+		t.Errorf("the upper directory should have the changes: %s, %v", b, err)
+	}
+	if fp.Dir(o.UpperDir) == tmpDir {
+		t.Errorf("the upper directory should be created for the run: %s", o.UpperDir)
+	}
+
+	upperDir := fp.Join(tmpDir, "upper")
+	run(upperDir, false, "lower")
+	if b, err := ioutil.ReadFile(fp.Join(upperDir, "etc/hosts")); err != nil || string(b) != "upper" {
+		t.Errorf("the upper directory should have the changes: %s, %v", b, err)
+	}
+	// A given upper directory is used again, and removed with its changes.
+	run(upperDir, true, "upper")
+	if _, err := os.Stat(upperDir); !os.IsNotExist(err) {
+		t.Errorf("%s should be removed: %v", upperDir, err)
+	}
+
+	fis, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// root and the directory of the first run, whose upper directory is kept.
+	if len(fis) != 2 {
+		t.Errorf("expected 2 entries in %s, got %d", tmpDir, len(fis))
+	}
+
+	if _, err := NewOverlay(lowerDir, "upper"); err == nil {
+		t.Error("relative upper directory should be error")
+	}
+}
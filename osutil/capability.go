@@ -0,0 +1,147 @@
+package osutil
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// capabilities are the names of capabilities(7), without the CAP_ prefix.
+var capabilities = map[string]uint{
+	"CHOWN":              0,
+	"DAC_OVERRIDE":       1,
+	"DAC_READ_SEARCH":    2,
+	"FOWNER":             3,
+	"FSETID":             4,
+	"KILL":               5,
+	"SETGID":             6,
+	"SETUID":             7,
+	"SETPCAP":            8,
+	"LINUX_IMMUTABLE":    9,
+	"NET_BIND_SERVICE":   10,
+	"NET_BROADCAST":      11,
+	"NET_ADMIN":          12,
+	"NET_RAW":            13,
+	"IPC_LOCK":           14,
+	"IPC_OWNER":          15,
+	"SYS_MODULE":         16,
+	"SYS_RAWIO":          17,
+	"SYS_CHROOT":         18,
+	"SYS_PTRACE":         19,
+	"SYS_PACCT":          20,
+	"SYS_ADMIN":          21,
+	"SYS_BOOT":           22,
+	"SYS_NICE":           23,
+	"SYS_RESOURCE":       24,
+	"SYS_TIME":           25,
+	"SYS_TTY_CONFIG":     26,
+	"MKNOD":              27,
+	"LEASE":              28,
+	"AUDIT_WRITE":        29,
+	"AUDIT_CONTROL":      30,
+	"SETFCAP":            31,
+	"MAC_OVERRIDE":       32,
+	"MAC_ADMIN":          33,
+	"SYSLOG":             34,
+	"WAKE_ALARM":         35,
+	"BLOCK_SUSPEND":      36,
+	"AUDIT_READ":         37,
+	"PERFMON":            38,
+	"BPF":                39,
+	"CHECKPOINT_RESTORE": 40,
+}
+
+// DefaultCapabilities are the capabilities a command run by droot keeps by default.
+var DefaultCapabilities = []string{
+	"CHOWN",
+	"DAC_OVERRIDE",
+	"DAC_READ_SEARCH",
+	"FOWNER",
+	"SETGID",
+	"SETUID",
+	"NET_BIND_SERVICE",
+}
+
+// ParseCapability returns the number of a capability named like NET_RAW or CAP_NET_RAW.
+func ParseCapability(name string) (uint, error) {
+	c, ok := capabilities[strings.TrimPrefix(strings.ToUpper(name), "CAP_")]
+	if !ok {
+		return 0, errors.Errorf("Unknown capability %s", name)
+	}
+	return c, nil
+}
+
+// CapabilityName returns the name of a capability, e.g. CAP_NET_RAW.
+func CapabilityName(c uint) string {
+	for name, n := range capabilities {
+		if n == c {
+			return "CAP_" + name
+		}
+	}
+	return "CAP_UNKNOWN"
+}
+
+// TweakCapabilities adds and drops capabilities of caps as `docker run --cap-add --cap-drop` does.
+// ALL in add adds all capabilities but the ones in drop, and takes precedence over ALL in drop,
+// which drops all but the ones in add.
+func TweakCapabilities(caps map[uint]bool, add, drop []string) (map[uint]bool, error) {
+	result := map[uint]bool{}
+	for c, ok := range caps {
+		result[c] = ok
+	}
+	addAll := containsAll(add)
+	switch {
+	case addAll:
+		for _, c := range capabilities {
+			result[c] = true
+		}
+	case containsAll(drop):
+		result = map[uint]bool{}
+	}
+	for _, name := range drop {
+		if strings.ToUpper(name) == "ALL" {
+			continue
+		}
+		c, err := ParseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		delete(result, c)
+	}
+	for _, name := range add {
+		if strings.ToUpper(name) == "ALL" {
+			continue
+		}
+		c, err := ParseCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		// Capabilities in drop are dropped from ALL, even if they are named in add too.
+		if !addAll {
+			result[c] = true
+		}
+	}
+	return result, nil
+}
+
+func containsAll(names []string) bool {
+	for _, name := range names {
+		if strings.ToUpper(name) == "ALL" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedCapabilities returns the capabilities of caps in ascending order.
+func sortedCapabilities(caps map[uint]bool) []uint {
+	var list []uint
+	for c, ok := range caps {
+		if ok {
+			list = append(list, c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
@@ -0,0 +1,45 @@
+package osutil
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Namespaces are the Linux namespaces droot can create.
+var Namespaces = []string{"cgroup", "ipc", "mount", "net", "pid", "uts"}
+
+// ParseNamespaces parses the names of namespaces, which may be separated by commas as in pid,mount.
+// A PID namespace needs its own /proc, so it comes with a mount namespace.
+func ParseNamespaces(specs []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, spec := range specs {
+		for _, name := range strings.Split(spec, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if !HasNamespace(Namespaces, name) {
+				return nil, errors.Errorf("Unknown namespace %s, not one of %s", name, strings.Join(Namespaces, ","))
+			}
+			set[name] = true
+		}
+	}
+	if set["pid"] {
+		set["mount"] = true
+	}
+	var namespaces []string
+	for name := range set {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// HasNamespace reports whether namespaces include the namespace name.
+func HasNamespace(namespaces []string, name string) bool {
+	for _, ns := range namespaces {
+		if ns == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package osutil
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/asmyasnikov/droot/log"
+)
+
+// cloneFlags are the flags of clone(2) creating the namespaces droot can create.
+var cloneFlags = map[string]uintptr{
+	"mount":  unix.CLONE_NEWNS,
+	"pid":    unix.CLONE_NEWPID,
+	"uts":    unix.CLONE_NEWUTS,
+	"ipc":    unix.CLONE_NEWIPC,
+	"net":    unix.CLONE_NEWNET,
+	"cgroup": unix.CLONE_NEWCGROUP,
+}
+
+// forwardedSignals are the signals RunInNamespaces forwards to the command.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH,
+}
+
+// RunInNamespaces runs a command in new namespaces, if any, as parsed by ParseNamespaces, with the standard
+// input and outputs of droot. The signals droot receives are forwarded to the command, which is killed
+// if droot dies. It returns the exit status of the command, or 128+n if it is killed by the signal n as
+// shells do.
+func RunInNamespaces(namespaces []string, name string, args []string, env []string) (int, error) {
+	var flags uintptr
+	for _, ns := range namespaces {
+		flags |= cloneFlags[ns]
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: flags, Pdeathsig: syscall.SIGKILL}
+
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	log.Debug("unshare", namespaces, name, args)
+	if err := cmd.Start(); err != nil {
+		return 0, errors.Wrapf(err, "Failed to run %s in namespaces %v", name, namespaces)
+	}
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	return 0, err
+}
+
+// Sethostname sets the hostname of the UTS namespace of droot.
+func Sethostname(name string) error {
+	log.Debug("sethostname", name)
+	return unix.Sethostname([]byte(name))
+}
+
+// SetLoopbackUp brings up the loopback interface, which is down in a new network namespace.
+func SetLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// struct ifreq, with the flags of the interface in its union.
+	var ifr struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, e1 := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); e1 != 0 {
+		return e1
+	}
+	ifr.flags |= unix.IFF_UP
+	log.Debug("ifup", "lo")
+	if _, _, e1 := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); e1 != 0 {
+		return e1
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package osutil
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func RunInNamespaces(namespaces []string, name string, args []string, env []string) (int, error) {
+	return 0, fmt.Errorf("osutil: RunInNamespaces not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func Sethostname(name string) error {
+	return fmt.Errorf("osutil: Sethostname not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func SetLoopbackUp() error {
+	return fmt.Errorf("osutil: SetLoopbackUp not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,21 @@
+package osutil
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseNamespaces(t *testing.T) {
+	namespaces, err := ParseNamespaces([]string{"uts,PID", "ipc", "uts"})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare([]string{"ipc", "mount", "pid", "uts"}, namespaces); diff != "" {
+		t.Errorf("diff: (-expected +got)\n%s", diff)
+	}
+
+	if _, err := ParseNamespaces([]string{"user"}); err == nil {
+		t.Error("should be error")
+	}
+}
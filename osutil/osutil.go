@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/docker/docker/pkg/mount"
 
@@ -88,6 +90,21 @@ func ForceMount(device, target, mType, options string) error {
 	return nil
 }
 
+// Mkdev returns the device number of major and minor numbers, encoded as Linux does.
+func Mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
+
+// Major returns the major number of the device number dev, the inverse of Mkdev.
+func Major(dev uint64) int64 {
+	return int64(((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff))
+}
+
+// Minor returns the minor number of the device number dev, the inverse of Mkdev.
+func Minor(dev uint64) int64 {
+	return int64((dev & 0xff) | ((dev >> 12) & 0xfff00))
+}
+
 // Mknod unless path does not exists.
 func Mknod(path string, mode uint32, dev int) error {
 	if ExistsFile(path) {
@@ -114,6 +131,47 @@ func Symlink(oldname, newname string) error {
 	return nil
 }
 
+// DefaultPath is the PATH of containers whose environment does not set it, as in Docker.
+const DefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// LookPath searches for an executable named file in the directories of PATH of env,
+// rather than of the environment of droot itself. A file containing a slash is not searched.
+func LookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		if err := findExecutable(file); err != nil {
+			return "", &exec.Error{Name: file, Err: err}
+		}
+		return file, nil
+	}
+	path := DefaultPath
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			path = strings.TrimPrefix(e, "PATH=")
+		}
+	}
+	for _, dir := range filepath.SplitList(path) {
+		if dir == "" {
+			dir = "."
+		}
+		name := filepath.Join(dir, file)
+		if err := findExecutable(name); err == nil {
+			return name, nil
+		}
+	}
+	return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+}
+
+func findExecutable(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if m := fi.Mode(); m.IsDir() || m&0111 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
 func Chroot(rootDir string) error {
 	log.Debug("chroot", rootDir)
 
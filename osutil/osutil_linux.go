@@ -1,10 +1,8 @@
 package osutil
 
 import (
-	"os/exec"
-	"os/user"
-	"strconv"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 
@@ -13,45 +11,16 @@ import (
 	"github.com/asmyasnikov/droot/log"
 )
 
-func LookupGroup(id string) (int, error) {
-	var g *user.Group
-
-	if _, err := strconv.Atoi(id); err == nil {
-		g, err = user.LookupGroupId(id)
-		if err != nil {
-			return -1, err
-		}
-	} else {
-		g, err = user.LookupGroup(id)
-		if err != nil {
-			return -1, err
-		}
-	}
-
-	return strconv.Atoi(g.Gid)
-}
-
-func LookupUser(id string) (int, error) {
-	var u *user.User
-
-	if _, err := strconv.Atoi(id); err == nil {
-		u, err = user.LookupId(id)
-		if err != nil {
-			return -1, err
-		}
-	} else {
-		u, err = user.Lookup(id)
-		if err != nil {
-			return -1, err
-		}
-	}
-
-	return strconv.Atoi(u.Uid)
-}
+// prctl and rawSyscall change the credentials of the calling thread.
+// Tests replace them to record the calls.
+var (
+	prctl      = unix.Prctl
+	rawSyscall = syscall.RawSyscall
+)
 
 // Setuid sets the uid of the calling thread to the specified uid.
 func Setuid(uid int) (err error) {
-	_, _, e1 := syscall.RawSyscall(syscall.SYS_SETUID, uintptr(uid), 0, 0)
+	_, _, e1 := rawSyscall(syscall.SYS_SETUID, uintptr(uid), 0, 0)
 	if e1 != 0 {
 		err = e1
 	}
@@ -60,7 +29,24 @@ func Setuid(uid int) (err error) {
 
 // Setgid sets the gid of the calling thread to the specified gid.
 func Setgid(gid int) (err error) {
-	_, _, e1 := syscall.RawSyscall(syscall.SYS_SETGID, uintptr(gid), 0, 0)
+	_, _, e1 := rawSyscall(syscall.SYS_SETGID, uintptr(gid), 0, 0)
+	if e1 != 0 {
+		err = e1
+	}
+	return
+}
+
+// Setgroups sets the supplementary groups of the calling thread.
+func Setgroups(gids []int) (err error) {
+	a := make([]uint32, len(gids))
+	for i, gid := range gids {
+		a[i] = uint32(gid)
+	}
+	var p unsafe.Pointer
+	if len(a) > 0 {
+		p = unsafe.Pointer(&a[0])
+	}
+	_, _, e1 := rawSyscall(syscall.SYS_SETGROUPS, uintptr(len(a)), uintptr(p), 0)
 	if e1 != 0 {
 		err = e1
 	}
@@ -74,7 +60,7 @@ func DropCapabilities(keepCaps map[uint]bool) error {
 			continue
 		}
 		log.Debug("prctl", "PR_CAPBSET_READ", i)
-		if err := unix.Prctl(unix.PR_CAPBSET_READ, uintptr(i), 0, 0, 0); err != nil {
+		if err := prctl(unix.PR_CAPBSET_READ, uintptr(i), 0, 0, 0); err != nil {
 			// Regard EINVAL as the condition of loop finish.
 			if errno, ok := err.(syscall.Errno); ok && errno == unix.EINVAL {
 				break
@@ -82,7 +68,7 @@ func DropCapabilities(keepCaps map[uint]bool) error {
 			return err
 		}
 		log.Debug("prctl", "PR_CAPBSET_DROP", i)
-		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0); err != nil {
+		if err := prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0); err != nil {
 			// Ignore EINVAL since the capability may not be supported in this system.
 			if errno, ok := err.(syscall.Errno); ok && errno == unix.EINVAL {
 				continue
@@ -101,8 +87,143 @@ func DropCapabilities(keepCaps map[uint]bool) error {
 	return nil
 }
 
+// Securebits of the calling thread, from linux/securebits.h.
+const (
+	secbitNoroot         = 1 << 0
+	secbitNorootLocked   = 1 << 1
+	secbitKeepCaps       = 1 << 4
+	secbitKeepCapsLocked = 1 << 5
+)
+
+// LockSecurebits makes the calling thread, and the programs it executes, never gain capabilities
+// by running as root or executing a setuid-root program. Its keep-capabilities flag is locked too,
+// as set by KeepCapabilities, and it is cleared when a program is executed.
+func LockSecurebits() error {
+	bits := secbitNoroot | secbitNorootLocked | secbitKeepCaps | secbitKeepCapsLocked
+	log.Debug("prctl", "PR_SET_SECUREBITS", bits)
+	return prctl(unix.PR_SET_SECUREBITS, uintptr(bits), 0, 0, 0)
+}
+
+// SetNoNewPrivileges sets no_new_privs on the calling thread, so that the programs it executes
+// can not gain privileges by setuid bits or file capabilities. It can never be unset.
+func SetNoNewPrivileges() error {
+	log.Debug("prctl", "PR_SET_NO_NEW_PRIVS", 1)
+	return prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+}
+
+// DropPrivileges switches the calling thread to a user, keeping only caps in its bounding set.
+// Root keeps caps in all its capability sets, but a user other than root only the capabilities of
+// ambient among them, which it was given explicitly. The bounding set is dropped and the securebits
+// of a user other than root are locked while the thread is still root, since both require CAP_SETPCAP.
+// The capabilities are set again after switching the user, which clears them.
+func DropPrivileges(uid, gid int, gids []int, caps, ambient map[uint]bool) error {
+	if err := DropCapabilities(caps); err != nil {
+		return errors.Wrapf(err, "Failed to drop capabilities")
+	}
+	if err := KeepCapabilities(); err != nil {
+		return errors.Wrapf(err, "Failed to keep capabilities")
+	}
+	if uid != 0 {
+		if err := LockSecurebits(); err != nil {
+			return errors.Wrapf(err, "Failed to lock securebits")
+		}
+	}
+	if err := SwitchUser(uid, gid, gids); err != nil {
+		return err
+	}
+	if uid == 0 {
+		return SetCapabilities(caps)
+	}
+	kept := map[uint]bool{}
+	for c := range ambient {
+		if caps[c] {
+			kept[c] = true
+		}
+	}
+	return SetCapabilities(kept)
+}
+
+// SwitchUser sets the supplementary groups, the group and the user of the calling thread.
+// The groups are set first, since they can not be changed without root.
+func SwitchUser(uid, gid int, gids []int) error {
+	if err := Setgroups(gids); err != nil {
+		return errors.Wrapf(err, "Failed to set supplementary groups %v", gids)
+	}
+	if err := Setgid(gid); err != nil {
+		return errors.Wrapf(err, "Failed to set group %d", gid)
+	}
+	if err := Setuid(uid); err != nil {
+		return errors.Wrapf(err, "Failed to set user %d", uid)
+	}
+	return nil
+}
+
+// PivotRoot makes rootDir the root directory of the mount namespace of droot with pivot_root(2),
+// and detaches the old root, so that the host filesystem can not be reached at all, unlike with
+// chroot(2). The mounts of the namespace must be private.
+func PivotRoot(rootDir string) error {
+	log.Debug("pivot_root", rootDir)
+
+	// The new root must be a mount point, with the mounts beneath it.
+	if err := unix.Mount(rootDir, rootDir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "Failed to bind mount %s", rootDir)
+	}
+	if err := unix.Chdir(rootDir); err != nil {
+		return err
+	}
+	// The old root is stacked on the new one, and detached then, as runc does.
+	// This needs no directory for the old root in the container.
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return err
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return errors.Wrapf(err, "Failed to detach the old root")
+	}
+	return unix.Chdir("/")
+}
+
+const (
+	stRdonly   = 0x1        // ST_RDONLY
+	tmpfsMagic = 0x01021994 // TMPFS_MAGIC
+)
+
+// IsReadonly reports whether path is on a read-only mount.
+func IsReadonly(path string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(path, &st) == nil && st.Flags&stRdonly != 0
+}
+
+// IsTmpfs reports whether path is on a tmpfs.
+func IsTmpfs(path string) bool {
+	var st unix.Statfs_t
+	return unix.Statfs(path, &st) == nil && st.Type == tmpfsMagic
+}
+
+// remountFlags are the flags of mount(2) a bind mount can be remounted with, by their names in mountinfo.
+var remountFlags = map[string]uintptr{
+	"ro":         unix.MS_RDONLY,
+	"nosuid":     unix.MS_NOSUID,
+	"nodev":      unix.MS_NODEV,
+	"noexec":     unix.MS_NOEXEC,
+	"noatime":    unix.MS_NOATIME,
+	"nodiratime": unix.MS_NODIRATIME,
+	"relatime":   unix.MS_RELATIME,
+}
+
+// RemountBind remounts the bind mount at target with the flags of options, e.g. ro and nosuid,
+// which replace its flags. Other options, such as rw, are ignored.
+func RemountBind(target string, options []string) error {
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND)
+	for _, opt := range options {
+		flags |= remountFlags[opt]
+	}
+	log.Debug("remount", target, options)
+	return unix.Mount("", target, "", flags, "")
+}
+
+// Execv executes cmd, which is searched in PATH of env, replacing the current process.
 func Execv(cmd string, args []string, env []string) error {
-	name, err := exec.LookPath(cmd)
+	name, err := LookPath(cmd, env)
 	if err != nil {
 		return err
 	}
@@ -111,3 +232,65 @@ func Execv(cmd string, args []string, env []string) error {
 
 	return syscall.Exec(name, args, env)
 }
+
+const linuxCapabilityVersion3 = 0x20080522
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// KeepCapabilities makes the calling thread keep its permitted capabilities when it switches
+// from root to another user, so that SetCapabilities can set them for that user.
+func KeepCapabilities() error {
+	log.Debug("prctl", "PR_SET_KEEPCAPS", 1)
+	return prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0)
+}
+
+// SetCapabilities sets the effective, permitted, inheritable and ambient capabilities
+// of the calling thread to caps. Ambient capabilities are kept by a program executed
+// by a user other than root, unlike the others.
+func SetCapabilities(caps map[uint]bool) error {
+	var list []uint
+	for _, c := range sortedCapabilities(caps) {
+		// Skip capabilities newer than the kernel.
+		if err := prctl(unix.PR_CAPBSET_READ, uintptr(c), 0, 0, 0); err == unix.EINVAL {
+			continue
+		}
+		list = append(list, c)
+	}
+	var data [2]capData
+	for _, c := range list {
+		data[c/32].effective |= 1 << (c % 32)
+	}
+	for i := range data {
+		data[i].permitted = data[i].effective
+		data[i].inheritable = data[i].effective
+	}
+	hdr := capHeader{version: linuxCapabilityVersion3}
+	log.Debug("capset", list)
+	if _, _, e1 := rawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); e1 != 0 {
+		return errors.Wrapf(e1, "Failed to set capabilities")
+	}
+
+	if err := prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		if err == unix.EINVAL {
+			log.Info("Ambient capabilities are not supported by the kernel, so a user other than root does not keep capabilities")
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to clear ambient capabilities")
+	}
+	for _, c := range list {
+		log.Debug("prctl", "PR_CAP_AMBIENT_RAISE", CapabilityName(c))
+		if err := prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return errors.Wrapf(err, "Failed to raise ambient capability %s", CapabilityName(c))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package osutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	"golang.org/x/sys/unix"
+)
+
+// recordCalls replaces prctl and rawSyscall with fakes recording their calls, on a kernel
+// supporting capabilities up to CAP_CHECKPOINT_RESTORE.
+func recordCalls(t *testing.T) *[]string {
+	calls := []string{}
+	prctl = func(option int, arg2, arg3, arg4, arg5 uintptr) error {
+		switch option {
+		case unix.PR_CAPBSET_READ:
+			if arg2 > 40 {
+				return unix.EINVAL
+			}
+			return nil
+		case unix.PR_CAPBSET_DROP:
+			calls = append(calls, fmt.Sprintf("PR_CAPBSET_DROP %d", arg2))
+		case unix.PR_SET_KEEPCAPS:
+			calls = append(calls, "PR_SET_KEEPCAPS")
+		case unix.PR_SET_SECUREBITS:
+			calls = append(calls, fmt.Sprintf("PR_SET_SECUREBITS %#x", arg2))
+		case unix.PR_SET_NO_NEW_PRIVS:
+			calls = append(calls, "PR_SET_NO_NEW_PRIVS")
+		case unix.PR_CAP_AMBIENT:
+			calls = append(calls, fmt.Sprintf("PR_CAP_AMBIENT %d %d", arg2, arg3))
+		default:
+			t.Fatalf("unexpected prctl %d", option)
+		}
+		return nil
+	}
+	rawSyscall = func(trap, a1, a2, a3 uintptr) (uintptr, uintptr, syscall.Errno) {
+		switch trap {
+		case syscall.SYS_SETGROUPS:
+			calls = append(calls, fmt.Sprintf("setgroups %d", a1))
+		case syscall.SYS_SETGID:
+			calls = append(calls, fmt.Sprintf("setgid %d", a1))
+		case syscall.SYS_SETUID:
+			calls = append(calls, fmt.Sprintf("setuid %d", a1))
+		case syscall.SYS_CAPSET:
+			calls = append(calls, "capset")
+		default:
+			t.Fatalf("unexpected syscall %d", trap)
+		}
+		return 0, 0, 0
+	}
+	return &calls
+}
+
+func TestDropPrivileges(t *testing.T) {
+	defer func(p func(int, uintptr, uintptr, uintptr, uintptr) error, r func(uintptr, uintptr, uintptr, uintptr) (uintptr, uintptr, syscall.Errno)) {
+		prctl, rawSyscall = p, r
+	}(prctl, rawSyscall)
+
+	var dropped []string
+	for c := 0; c <= 40; c++ {
+		if c != 7 && c != 10 {
+			dropped = append(dropped, fmt.Sprintf("PR_CAPBSET_DROP %d", c))
+		}
+	}
+	caps := map[uint]bool{7: true, 10: true}   // CAP_SETUID, CAP_NET_BIND_SERVICE
+	added := map[uint]bool{10: true, 21: true} // CAP_NET_BIND_SERVICE, CAP_SYS_ADMIN
+
+	// The bounding set and the securebits must be changed before the user is switched,
+	// while the thread still has CAP_SETPCAP, and the keep-capabilities flag before it is locked.
+	calls := recordCalls(t)
+	// A user other than root only keeps the kept capabilities it was given explicitly.
+	if err := DropPrivileges(1234, 1234, []int{1234, 50}, caps, added); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected := append(dropped, "PR_SET_KEEPCAPS", "PR_SET_SECUREBITS 0x33", "setgroups 2", "setgid 1234", "setuid 1234", "capset", "PR_CAP_AMBIENT 4 0", "PR_CAP_AMBIENT 2 10")
+	if diff := pretty.Compare(expected, *calls); diff != "" {
+		t.Errorf("diff: (-expected +got)\n%s", diff)
+	}
+
+	// The securebits of root are left alone, since SECBIT_NOROOT would take its privileges of root.
+	calls = recordCalls(t)
+	if err := DropPrivileges(0, 0, []int{0}, caps, nil); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected = append(dropped, "PR_SET_KEEPCAPS", "setgroups 1", "setgid 0", "setuid 0", "capset", "PR_CAP_AMBIENT 4 0", "PR_CAP_AMBIENT 2 7", "PR_CAP_AMBIENT 2 10")
+	if diff := pretty.Compare(expected, *calls); diff != "" {
+		t.Errorf("diff: (-expected +got)\n%s", diff)
+	}
+}
+
+func TestRunInNamespaces(t *testing.T) {
+	cases := map[string]int{
+		"exit 3":     3,
+		"kill -9 $$": 128 + 9,
+	}
+	for script, expected := range cases {
+		status, err := RunInNamespaces(nil, "/bin/sh", []string{"-c", script}, nil)
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if status != expected {
+			t.Errorf("%s: expected status %d, got %d", script, expected, status)
+		}
+	}
+}
+
+// TestPivotRootProcess pivots to the root directory DROOT_TEST_PIVOT_ROOT in a mount namespace created by TestPivotRoot.
+func TestPivotRootProcess(t *testing.T) {
+	rootDir := os.Getenv("DROOT_TEST_PIVOT_ROOT")
+	if rootDir == "" {
+		t.Skip("run by TestPivotRoot")
+	}
+	runtime.LockOSThread()
+	if err := ForceMount("", "/", "none", "rprivate"); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := PivotRoot(rootDir); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if !ExistsFile("/droot") {
+		t.Error("/droot of the new root should exist")
+	}
+	if ExistsDir(rootDir) {
+		t.Errorf("%s of the old root should not be reachable", rootDir)
+	}
+}
+
+func TestPivotRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating a mount namespace requires root")
+	}
+	rootDir, err := ioutil.TempDir("", "droot_pivot_root")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(rootDir)
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "droot"), nil, 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	env := append(os.Environ(), "DROOT_TEST_PIVOT_ROOT="+rootDir)
+	status, err := RunInNamespaces([]string{"mount"}, os.Args[0], []string{"-test.run=^TestPivotRootProcess$"}, env)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if status != 0 {
+		t.Errorf("TestPivotRootProcess should succeed, got status %d", status)
+	}
+}
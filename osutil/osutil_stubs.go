@@ -11,16 +11,12 @@ func Execv(cmd string, args []string, env []string) error {
 	return fmt.Errorf("osutil: Execv not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
 }
 
-func LookupGroup(id string) (int, error) {
-	return -1, fmt.Errorf("osutil: LookupGroup not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
-}
-
 func Setgid(id int) error {
 	return fmt.Errorf("osutil: Setgid not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
 }
 
-func LookupUser(id string) (int, error) {
-	return -1, fmt.Errorf("osutil: LookupUser not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+func Setgroups(gids []int) error {
+	return fmt.Errorf("osutil: Setgroups not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
 }
 
 func Setuid(id int) error {
@@ -30,3 +26,43 @@ func Setuid(id int) error {
 func DropCapabilities(keepCaps map[uint]bool) error {
 	return fmt.Errorf("osutil: DropCapabilities not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
 }
+
+func KeepCapabilities() error {
+	return fmt.Errorf("osutil: KeepCapabilities not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func SetCapabilities(caps map[uint]bool) error {
+	return fmt.Errorf("osutil: SetCapabilities not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func LockSecurebits() error {
+	return fmt.Errorf("osutil: LockSecurebits not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func SetNoNewPrivileges() error {
+	return fmt.Errorf("osutil: SetNoNewPrivileges not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func DropPrivileges(uid, gid int, gids []int, caps, ambient map[uint]bool) error {
+	return fmt.Errorf("osutil: DropPrivileges not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func SwitchUser(uid, gid int, gids []int) error {
+	return fmt.Errorf("osutil: SwitchUser not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func PivotRoot(rootDir string) error {
+	return fmt.Errorf("osutil: PivotRoot not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func IsReadonly(path string) bool {
+	return false
+}
+
+func IsTmpfs(path string) bool {
+	return false
+}
+
+func RemountBind(target string, options []string) error {
+	return fmt.Errorf("osutil: RemountBind not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
@@ -3,6 +3,7 @@ package osutil
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -121,3 +122,57 @@ func TestSymlink(t *testing.T) {
 	}
 	os.Remove(tmp.Name() + "/symlink")
 }
+
+func TestLookPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "droot_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "app"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bin, "data"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := []string{"HOME=/root", "PATH=/path/to/notexist:" + bin}
+	if name, err := LookPath("app", env); err != nil || name != filepath.Join(bin, "app") {
+		t.Errorf("app should be found in PATH of env: %s, %v", name, err)
+	}
+	if _, err := LookPath("data", env); err == nil {
+		t.Error("data should not be found, since it is not executable")
+	}
+	if _, err := LookPath("app", []string{"PATH=/path/to/notexist"}); err == nil {
+		t.Error("app should not be found in PATH of droot")
+	}
+	if name, err := LookPath(filepath.Join(bin, "app"), nil); err != nil || name != filepath.Join(bin, "app") {
+		t.Errorf("a path should not be searched: %s, %v", name, err)
+	}
+}
+
+func TestMkdev(t *testing.T) {
+	for _, c := range []struct {
+		major, minor int64
+		dev          int
+	}{
+		{1, 3, 0x103},
+		{1, 5, 0x105},
+		{5, 0, 0x500},
+		{10, 229, 0xae5},
+		{259, 0x12345, 0x12310345},
+		{0x1234, 1, 0x100000023401},
+	} {
+		dev := Mkdev(c.major, c.minor)
+		if dev != c.dev {
+			t.Errorf("Mkdev(%d, %d): expected %#x, got %#x", c.major, c.minor, c.dev, dev)
+		}
+		if major, minor := Major(uint64(dev)), Minor(uint64(dev)); major != c.major || minor != c.minor {
+			t.Errorf("Major and Minor of %#x: expected %d,%d, got %d,%d", dev, c.major, c.minor, major, minor)
+		}
+	}
+}
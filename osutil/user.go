@@ -0,0 +1,240 @@
+package osutil
+
+import (
+	"bufio"
+	"io"
+	"os"
+	fp "path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+)
+
+// User is an entry of passwd(5).
+type User struct {
+	Name  string
+	Uid   int
+	Gid   int
+	Home  string
+	Shell string
+}
+
+// Group is an entry of group(5).
+type Group struct {
+	Name    string
+	Gid     int
+	Members []string
+}
+
+// ExecUser is the user, resolved in a container, which a process runs as.
+type ExecUser struct {
+	Name string // empty if the uid has no passwd entry
+	Uid  int
+	Gid  int
+	Home string
+}
+
+// ParsePasswd parses passwd(5), skipping comments and malformed lines.
+func ParsePasswd(r io.Reader) ([]User, error) {
+	var users []User
+	err := parseLines(r, func(f []string) {
+		if len(f) < 4 {
+			return
+		}
+		uid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return
+		}
+		gid, err := strconv.Atoi(f[3])
+		if err != nil {
+			return
+		}
+		u := User{Name: f[0], Uid: uid, Gid: gid}
+		if len(f) > 5 {
+			u.Home = f[5]
+		}
+		if len(f) > 6 {
+			u.Shell = f[6]
+		}
+		users = append(users, u)
+	})
+	return users, err
+}
+
+// ParseGroup parses group(5), skipping comments and malformed lines.
+func ParseGroup(r io.Reader) ([]Group, error) {
+	var groups []Group
+	err := parseLines(r, func(f []string) {
+		if len(f) < 3 {
+			return
+		}
+		gid, err := strconv.Atoi(f[2])
+		if err != nil {
+			return
+		}
+		g := Group{Name: f[0], Gid: gid}
+		if len(f) > 3 && f[3] != "" {
+			g.Members = strings.Split(f[3], ",")
+		}
+		groups = append(groups, g)
+	})
+	return groups, err
+}
+
+func parseLines(r io.Reader, parse func([]string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parse(strings.Split(l, ":"))
+	}
+	return scanner.Err()
+}
+
+// openInRoot opens the file at path of the container in rootDir, resolving the symbolic links
+// of the container within rootDir, so that they can not point to files of the host.
+func openInRoot(rootDir, path string) (*os.File, error) {
+	name, err := symlink.FollowSymlinkInScope(fp.Join(rootDir, path), rootDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to resolve %s in the container", path)
+	}
+	return os.Open(name)
+}
+
+// ReadPasswd reads /etc/passwd of the container in rootDir. A missing file has no entries.
+func ReadPasswd(rootDir string) ([]User, error) {
+	f, err := openInRoot(rootDir, "/etc/passwd")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePasswd(f)
+}
+
+// ReadGroup reads /etc/group of the container in rootDir. A missing file has no entries.
+func ReadGroup(rootDir string) ([]Group, error) {
+	f, err := openInRoot(rootDir, "/etc/group")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseGroup(f)
+}
+
+// ResolveUser resolves a user spec of Docker (USER, UID, USER:GROUP, UID:GID, USER:GID or UID:GROUP)
+// against the passwd and group entries of a container, as `docker run --user` does.
+// An empty spec is root. A UID or GID without an entry is used as it is,
+// while a name without an entry is an error.
+func ResolveUser(spec string, users []User, groups []Group) (*ExecUser, error) {
+	userSpec, groupSpec := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		userSpec, groupSpec = spec[:i], spec[i+1:]
+	}
+	if userSpec == "" {
+		userSpec = "0"
+	}
+
+	u := &ExecUser{Home: "/"}
+	uid, err := strconv.Atoi(userSpec)
+	isUid := err == nil
+	found := false
+	for _, e := range users {
+		if (isUid && e.Uid == uid) || (!isUid && e.Name == userSpec) {
+			u.Name, u.Uid, u.Gid = e.Name, e.Uid, e.Gid
+			if e.Home != "" {
+				u.Home = e.Home
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		if !isUid {
+			return nil, errors.Errorf("No such user %s in the container", userSpec)
+		}
+		if uid < 0 {
+			return nil, errors.Errorf("Invalid uid %d", uid)
+		}
+		u.Uid = uid
+	}
+
+	if groupSpec == "" {
+		return u, nil
+	}
+	gid, err := strconv.Atoi(groupSpec)
+	if err == nil {
+		if gid < 0 {
+			return nil, errors.Errorf("Invalid gid %d", gid)
+		}
+		u.Gid = gid
+		return u, nil
+	}
+	for _, g := range groups {
+		if g.Name == groupSpec {
+			u.Gid = g.Gid
+			return u, nil
+		}
+	}
+	return nil, errors.Errorf("No such group %s in the container", groupSpec)
+}
+
+// InitGroups returns the supplementary groups of u as initgroups(3) does:
+// its primary group and the groups which list it as a member.
+func InitGroups(u *ExecUser, groups []Group) []int {
+	gids := []int{u.Gid}
+	if u.Name == "" {
+		return gids
+	}
+	for _, g := range groups {
+		for _, m := range g.Members {
+			if m == u.Name {
+				gids = appendGid(gids, g.Gid)
+				break
+			}
+		}
+	}
+	return gids
+}
+
+// LookupGroups resolves group names or GIDs, e.g. of `--group-add`, in the group entries of a container.
+func LookupGroups(specs []string, groups []Group) ([]int, error) {
+	var gids []int
+	for _, spec := range specs {
+		gid, err := strconv.Atoi(spec)
+		if err != nil {
+			gid = -1
+			for _, g := range groups {
+				if g.Name == spec {
+					gid = g.Gid
+					break
+				}
+			}
+			if gid < 0 {
+				return nil, errors.Errorf("No such group %s in the container", spec)
+			}
+		} else if gid < 0 {
+			return nil, errors.Errorf("Invalid gid %d", gid)
+		}
+		gids = appendGid(gids, gid)
+	}
+	return gids, nil
+}
+
+func appendGid(gids []int, gid int) []int {
+	for _, g := range gids {
+		if g == gid {
+			return gids
+		}
+	}
+	return append(gids, gid)
+}
@@ -0,0 +1,153 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+# comment
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+broken:x:notanumber:1000::/:/bin/sh
+`
+
+const testGroup = `root:x:0:
+daemon:x:1:
+app:x:1000:
+www-data:x:33:app,daemon
+`
+
+func TestParseGroup(t *testing.T) {
+	groups, err := ParseGroup(strings.NewReader(testGroup))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected := []Group{
+		{Name: "root", Gid: 0},
+		{Name: "daemon", Gid: 1},
+		{Name: "app", Gid: 1000},
+		{Name: "www-data", Gid: 33, Members: []string{"app", "daemon"}},
+	}
+	if diff := pretty.Compare(groups, expected); diff != "" {
+		t.Fatalf("diff: (-actual +expected)\n%s", diff)
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	users, err := ParsePasswd(strings.NewReader(testPasswd))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("malformed entries should be skipped: got %+v", users)
+	}
+	groups, err := ParseGroup(strings.NewReader(testGroup))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	cases := map[string]ExecUser{
+		"":              {Name: "root", Uid: 0, Gid: 0, Home: "/root"},
+		"app":           {Name: "app", Uid: 1000, Gid: 1000, Home: "/home/app"},
+		"1000":          {Name: "app", Uid: 1000, Gid: 1000, Home: "/home/app"},
+		"app:www-data":  {Name: "app", Uid: 1000, Gid: 33, Home: "/home/app"},
+		"app:33":        {Name: "app", Uid: 1000, Gid: 33, Home: "/home/app"},
+		"1000:www-data": {Name: "app", Uid: 1000, Gid: 33, Home: "/home/app"},
+		"2000":          {Uid: 2000, Gid: 0, Home: "/"},
+		"2000:2000":     {Uid: 2000, Gid: 2000, Home: "/"},
+		":www-data":     {Name: "root", Uid: 0, Gid: 33, Home: "/root"},
+	}
+	for spec, expected := range cases {
+		u, err := ResolveUser(spec, users, groups)
+		if err != nil {
+			t.Errorf("%s: should not be error: %v", spec, err)
+			continue
+		}
+		if diff := pretty.Compare(*u, expected); diff != "" {
+			t.Errorf("%s: diff: (-actual +expected)\n%s", spec, diff)
+		}
+	}
+
+	for _, spec := range []string{"nobody", "app:nogroup", "-1"} {
+		if _, err := ResolveUser(spec, users, groups); err == nil {
+			t.Errorf("%s: should be error", spec)
+		}
+	}
+}
+
+func TestInitGroups(t *testing.T) {
+	groups, err := ParseGroup(strings.NewReader(testGroup))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(InitGroups(&ExecUser{Name: "app", Uid: 1000, Gid: 1000}, groups), []int{1000, 33}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+	if diff := pretty.Compare(InitGroups(&ExecUser{Uid: 2000, Gid: 2000}, groups), []int{2000}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	gids, err := LookupGroups([]string{"www-data", "4321", "33"}, groups)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(gids, []int{33, 4321}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+	if _, err := LookupGroups([]string{"nogroup"}, groups); err == nil {
+		t.Error("should be error")
+	}
+}
+
+func TestReadPasswdInRoot(t *testing.T) {
+	hostDir, err := ioutil.TempDir("", "droot_host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hostDir)
+	rootDir, err := ioutil.TempDir("", "droot_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	// /etc of the container points to a directory of the host, which must not be read.
+	ioutil.WriteFile(filepath.Join(hostDir, "passwd"), []byte(testPasswd), 0644)
+	ioutil.WriteFile(filepath.Join(hostDir, "group"), []byte(testGroup), 0644)
+	if err := os.Symlink(hostDir, filepath.Join(rootDir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	users, err := ReadPasswd(rootDir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("should not read passwd of the host: %v", users)
+	}
+	groups, err := ReadGroup(rootDir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if len(groups) != 0 {
+		t.Errorf("should not read group of the host: %v", groups)
+	}
+
+	// The link is resolved within the container instead.
+	if err := os.MkdirAll(filepath.Join(rootDir, hostDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(rootDir, hostDir, "passwd"), []byte("app:x:1000:1000::/home/app:/bin/sh\n"), 0644)
+	users, err = ReadPasswd(rootDir)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(users, []User{{Name: "app", Uid: 1000, Gid: 1000, Home: "/home/app", Shell: "/bin/sh"}}); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+}
@@ -0,0 +1,161 @@
+package seccomp
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Instruction is a classic BPF instruction, laid out as struct sock_filter.
+type Instruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// Opcodes of classic BPF used by seccomp filters.
+const (
+	bpfLdAbs  = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfAndK   = 0x54 // BPF_ALU | BPF_AND | BPF_K
+	bpfJa     = 0x05 // BPF_JMP | BPF_JA
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgtK   = 0x25 // BPF_JMP | BPF_JGT | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+	maxInsns  = 4096 // BPF_MAXINSNS
+	noLabel   = -1
+	dataNr    = 0  // offsetof(struct seccomp_data, nr)
+	dataArch  = 4  // offsetof(struct seccomp_data, arch)
+	dataArgs  = 16 // offsetof(struct seccomp_data, args)
+	argsCount = 6
+)
+
+// assembler builds a BPF program. Conditional jumps of BPF can only skip up to 255
+// instructions forward, so they only skip a few instructions nearby, and farther
+// targets are reached by unconditional jumps to labels, which are resolved at the end.
+type assembler struct {
+	insns  []Instruction
+	labels []int // instruction index of each label
+	jumps  []int // label jumped to by each instruction, or noLabel
+}
+
+func (a *assembler) emit(code uint16, jt, jf uint8, k uint32) {
+	a.insns = append(a.insns, Instruction{Code: code, Jt: jt, Jf: jf, K: k})
+	a.jumps = append(a.jumps, noLabel)
+}
+
+// label returns a new label, to be placed with place.
+func (a *assembler) label() int {
+	a.labels = append(a.labels, noLabel)
+	return len(a.labels) - 1
+}
+
+// place places the label l at the next instruction.
+func (a *assembler) place(l int) {
+	a.labels[l] = len(a.insns)
+}
+
+func (a *assembler) load(offset uint32) {
+	a.emit(bpfLdAbs, 0, 0, offset)
+}
+
+func (a *assembler) ret(k uint32) {
+	a.emit(bpfRetK, 0, 0, k)
+}
+
+// jump jumps to the label l.
+func (a *assembler) jump(l int) {
+	a.emit(bpfJa, 0, 0, 0)
+	a.jumps[len(a.jumps)-1] = l
+}
+
+// jumpIfNot jumps to the label l unless the accumulator equals k.
+func (a *assembler) jumpIfNot(k uint32, l int) {
+	a.emit(bpfJeqK, 1, 0, k)
+	a.jump(l)
+}
+
+// jumpIf jumps to the label l if the accumulator equals k.
+func (a *assembler) jumpIf(k uint32, l int) {
+	a.emit(bpfJeqK, 0, 1, k)
+	a.jump(l)
+}
+
+// assemble resolves the labels and returns the program.
+func (a *assembler) assemble() ([]Instruction, error) {
+	if len(a.insns) > maxInsns {
+		return nil, errors.Errorf("Seccomp filter has %d instructions, more than the %d the kernel accepts", len(a.insns), maxInsns)
+	}
+	insns := make([]Instruction, len(a.insns))
+	copy(insns, a.insns)
+	for i, l := range a.jumps {
+		if l == noLabel {
+			continue
+		}
+		target := a.labels[l]
+		if target <= i {
+			return nil, errors.Errorf("Seccomp filter jumps backward from instruction %d", i)
+		}
+		insns[i].K = uint32(target - i - 1)
+	}
+	return insns, nil
+}
+
+// compare emits the 64-bit comparison of the argument index of a syscall with a condition,
+// falling through if it holds and jumping to the label fail otherwise.
+// BPF loads 32-bit words, so the high and the low words of the argument are compared in turn.
+func (a *assembler) compare(arg Arg, fail int) error {
+	if arg.Index >= argsCount {
+		return errors.Errorf("Invalid seccomp argument index %d", arg.Index)
+	}
+	// All the architectures droot builds filters for are little-endian.
+	lo := uint32(dataArgs + 8*arg.Index)
+	hi := lo + 4
+	vhi, vlo := uint32(arg.Value>>32), uint32(arg.Value)
+	switch arg.Op {
+	case OpEqualTo:
+		a.load(hi)
+		a.jumpIfNot(vhi, fail)
+		a.load(lo)
+		a.jumpIfNot(vlo, fail)
+	case OpNotEqual:
+		a.load(hi)
+		a.emit(bpfJeqK, 0, 3, vhi) // the high words differ
+		a.load(lo)
+		a.emit(bpfJeqK, 0, 1, vlo)
+		a.jump(fail)
+	case OpGreaterThan, OpGreaterEqual:
+		op := uint16(bpfJgtK)
+		if arg.Op == OpGreaterEqual {
+			op = bpfJgeK
+		}
+		a.load(hi)
+		a.emit(bpfJgtK, 4, 0, vhi)
+		a.emit(bpfJeqK, 0, 2, vhi)
+		a.load(lo)
+		a.emit(op, 1, 0, vlo)
+		a.jump(fail)
+	case OpLessThan, OpLessEqual:
+		// The argument is less than the value unless it is greater or equal, or greater.
+		op := uint16(bpfJgeK)
+		if arg.Op == OpLessEqual {
+			op = bpfJgtK
+		}
+		a.load(hi)
+		a.emit(bpfJgeK, 0, 4, vhi)
+		a.emit(bpfJeqK, 0, 2, vhi)
+		a.load(lo)
+		a.emit(op, 0, 1, vlo)
+		a.jump(fail)
+	case OpMaskedEqual:
+		thi, tlo := uint32(arg.ValueTwo>>32), uint32(arg.ValueTwo)
+		a.load(hi)
+		a.emit(bpfAndK, 0, 0, vhi)
+		a.jumpIfNot(thi, fail)
+		a.load(lo)
+		a.emit(bpfAndK, 0, 0, vlo)
+		a.jumpIfNot(tlo, fail)
+	default:
+		return errors.Errorf("Unknown seccomp operator %s", arg.Op)
+	}
+	return nil
+}
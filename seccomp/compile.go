@@ -0,0 +1,324 @@
+package seccomp
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// Return values of seccomp filters, from linux/seccomp.h.
+const (
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+	retDataMask    = 0x0000ffff
+)
+
+// x32 syscalls run on x86_64 with this bit set in their number.
+const x32SyscallBit = 0x40000000
+
+type arch struct {
+	audit    uint32 // AUDIT_ARCH_*, from linux/audit.h
+	syscalls map[string]int
+	goarches []string // names of the architecture in includes and excludes of rules
+}
+
+var arches = map[string]*arch{
+	"SCMP_ARCH_X86_64":  {audit: 0xc000003e, syscalls: syscallsX86_64, goarches: []string{"amd64"}},
+	"SCMP_ARCH_X86":     {audit: 0x40000003, syscalls: syscallsX86, goarches: []string{"386", "x86"}},
+	"SCMP_ARCH_AARCH64": {audit: 0xc00000b7, syscalls: syscallsAArch64, goarches: []string{"arm64"}},
+	"SCMP_ARCH_ARM":     {audit: 0x40000028, syscalls: syscallsARM, goarches: []string{"arm"}},
+}
+
+// nativeArches maps the architectures droot builds for to the ones whose syscalls they run.
+var nativeArches = map[string][]string{
+	"amd64": {"SCMP_ARCH_X86_64", "SCMP_ARCH_X86"},
+	"386":   {"SCMP_ARCH_X86"},
+	"arm64": {"SCMP_ARCH_AARCH64", "SCMP_ARCH_ARM"},
+	"arm":   {"SCMP_ARCH_ARM"},
+}
+
+// Compile compiles a profile into a BPF program for the architecture droot runs on,
+// keeping the rules which apply to a container with the capabilities caps.
+// Syscalls unknown to droot are ignored, as they are by Docker on older kernels.
+func Compile(p *Profile, caps map[uint]bool) ([]Instruction, error) {
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the kernel version")
+	}
+	return compile(p, runtime.GOARCH, caps, kernel)
+}
+
+// rule is a rule of a profile for a syscall, whose conditions must all hold.
+type rule struct {
+	action uint32
+	args   []Arg
+}
+
+func compile(p *Profile, goarch string, caps map[uint]bool, kernel [2]int) ([]Instruction, error) {
+	native, ok := nativeArches[goarch]
+	if !ok {
+		return nil, errors.Errorf("Seccomp is not supported on %s", goarch)
+	}
+	defaultAction, err := action(p.DefaultAction, p.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	archNames := filterArches(p, native)
+
+	var rules []*Syscall
+	for i := range p.Syscalls {
+		s := &p.Syscalls[i]
+		ok, err := applies(s, goarch, caps, kernel)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, s)
+		}
+	}
+
+	a := &assembler{}
+	archLabels := make([]int, len(archNames))
+	a.load(dataArch)
+	for i, name := range archNames {
+		archLabels[i] = a.label()
+		a.jumpIf(arches[name].audit, archLabels[i])
+	}
+	// Syscalls of other architectures could bypass the rules, since they have other numbers.
+	a.ret(retKillThread)
+	for i, name := range archNames {
+		a.place(archLabels[i])
+		if err := compileArch(a, name, rules, defaultAction); err != nil {
+			return nil, err
+		}
+	}
+	return a.assemble()
+}
+
+func compileArch(a *assembler, name string, syscalls []*Syscall, defaultAction uint32) error {
+	arch := arches[name]
+	var nrs []int
+	rules := map[int][]rule{}
+	for _, s := range syscalls {
+		act, err := action(s.Action, s.ErrnoRet)
+		if err != nil {
+			return err
+		}
+		names := s.Names
+		if s.Name != "" {
+			names = append([]string{s.Name}, names...)
+		}
+		for _, n := range names {
+			nr, ok := arch.syscalls[n]
+			if !ok {
+				log.Debugf("Skip seccomp rule for unknown syscall %s on %s", n, name)
+				continue
+			}
+			if _, ok := rules[nr]; !ok {
+				nrs = append(nrs, nr)
+			}
+			rules[nr] = append(rules[nr], splitRule(act, s.Args)...)
+		}
+	}
+
+	a.load(dataNr)
+	if name == "SCMP_ARCH_X86_64" {
+		a.emit(bpfJgeK, 0, 1, x32SyscallBit)
+		a.ret(retKillThread)
+	}
+	labels := map[int]int{}
+	for _, nr := range nrs {
+		if rs := rules[nr]; len(rs[0].args) == 0 {
+			// The first rule of the syscall matches whatever its arguments are.
+			a.emit(bpfJeqK, 0, 1, uint32(nr))
+			a.ret(rs[0].action)
+			continue
+		}
+		labels[nr] = a.label()
+		a.jumpIf(uint32(nr), labels[nr])
+	}
+	a.ret(defaultAction)
+
+	for _, nr := range nrs {
+		l, ok := labels[nr]
+		if !ok {
+			continue
+		}
+		a.place(l)
+		fallback := defaultAction
+		for _, r := range rules[nr] {
+			if len(r.args) == 0 {
+				fallback = r.action
+				break
+			}
+			next := a.label()
+			for _, arg := range r.args {
+				if err := a.compare(arg, next); err != nil {
+					return err
+				}
+			}
+			a.ret(r.action)
+			a.place(next)
+		}
+		a.ret(fallback)
+	}
+	return nil
+}
+
+// splitRule returns the rules for a syscall of a profile. Like runc does, conditions on the
+// same argument mean any of them must hold, so each condition becomes a rule then.
+func splitRule(act uint32, args []Arg) []rule {
+	indexes := map[uint]bool{}
+	for _, arg := range args {
+		if indexes[arg.Index] {
+			var rules []rule
+			for _, arg := range args {
+				rules = append(rules, rule{action: act, args: []Arg{arg}})
+			}
+			return rules
+		}
+		indexes[arg.Index] = true
+	}
+	return []rule{{action: act, args: args}}
+}
+
+// filterArches returns the architectures the filter checks syscalls of:
+// the native one, and the ones it also runs which the profile lists.
+func filterArches(p *Profile, native []string) []string {
+	listed := map[string]bool{}
+	for _, name := range p.Architectures {
+		listed[name] = true
+	}
+	for _, m := range p.ArchMap {
+		if m.Arch != native[0] {
+			continue
+		}
+		for _, name := range m.SubArches {
+			listed[name] = true
+		}
+	}
+	names := []string{native[0]}
+	for _, name := range native[1:] {
+		if listed[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// applies reports whether the rule s applies to a container, as Docker does:
+// it must match all its includes and none of its excludes.
+func applies(s *Syscall, goarch string, caps map[uint]bool, kernel [2]int) (bool, error) {
+	goarches := arches[nativeArches[goarch][0]].goarches
+	if len(s.Includes.Arches) > 0 && !containsAny(s.Includes.Arches, goarches) {
+		return false, nil
+	}
+	if containsAny(s.Excludes.Arches, goarches) {
+		return false, nil
+	}
+	for _, c := range s.Includes.Caps {
+		if !hasCapability(caps, c) {
+			return false, nil
+		}
+	}
+	for _, c := range s.Excludes.Caps {
+		if hasCapability(caps, c) {
+			return false, nil
+		}
+	}
+	if s.Includes.MinKernel != "" {
+		min, err := parseKernelVersion(s.Includes.MinKernel)
+		if err != nil {
+			return false, err
+		}
+		if olderKernel(kernel, min) {
+			return false, nil
+		}
+	}
+	if s.Excludes.MinKernel != "" {
+		min, err := parseKernelVersion(s.Excludes.MinKernel)
+		if err != nil {
+			return false, err
+		}
+		if !olderKernel(kernel, min) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func containsAny(list, values []string) bool {
+	for _, l := range list {
+		for _, v := range values {
+			if l == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasCapability(caps map[uint]bool, name string) bool {
+	c, err := osutil.ParseCapability(name)
+	return err == nil && caps[c]
+}
+
+// action returns the return value of a filter for an action.
+// The errno of SCMP_ACT_ERRNO, and the data of SCMP_ACT_TRACE, default to EPERM as in runc.
+func action(act Action, errnoRet *uint) (uint32, error) {
+	data := uint32(errnoEPERM)
+	if errnoRet != nil {
+		data = uint32(*errnoRet) & retDataMask
+	}
+	switch act {
+	case ActKill, ActKillThread:
+		return retKillThread, nil
+	case ActKillProcess:
+		return retKillProcess, nil
+	case ActTrap:
+		return retTrap, nil
+	case ActErrno:
+		return retErrno | data, nil
+	case ActTrace:
+		return retTrace | data, nil
+	case ActLog:
+		return retLog, nil
+	case ActAllow:
+		return retAllow, nil
+	}
+	return 0, errors.Errorf("Unsupported seccomp action %s", act)
+}
+
+// parseKernelVersion parses the major and minor version of a kernel, e.g. 4.8 or 5.10.0-generic.
+func parseKernelVersion(s string) ([2]int, error) {
+	var v [2]int
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) < 2 {
+		return v, errors.Errorf("Invalid kernel version %s", s)
+	}
+	for i := range v {
+		n := parts[i]
+		if j := strings.IndexFunc(n, func(r rune) bool { return r < '0' || r > '9' }); j >= 0 {
+			n = n[:j]
+		}
+		var err error
+		if v[i], err = strconv.Atoi(n); err != nil {
+			return v, errors.Errorf("Invalid kernel version %s", s)
+		}
+	}
+	return v, nil
+}
+
+func olderKernel(v, than [2]int) bool {
+	return v[0] < than[0] || (v[0] == than[0] && v[1] < than[1])
+}
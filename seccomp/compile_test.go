@@ -0,0 +1,200 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+)
+
+const (
+	auditArchX86_64 = 0xc000003e
+	auditArchI386   = 0x40000003
+)
+
+// run runs a seccomp filter on the seccomp_data of a syscall, as the kernel does.
+func run(t *testing.T, filter []Instruction, arch uint32, nr int, args ...uint64) uint32 {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data[dataNr:], uint32(nr))
+	binary.LittleEndian.PutUint32(data[dataArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[dataArgs+8*i:], arg)
+	}
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		in := filter[pc]
+		switch in.Code {
+		case bpfLdAbs:
+			acc = binary.LittleEndian.Uint32(data[in.K:])
+		case bpfAndK:
+			acc &= in.K
+		case bpfJa:
+			pc += int(in.K)
+		case bpfJeqK, bpfJgtK, bpfJgeK:
+			cond := acc == in.K
+			if in.Code == bpfJgtK {
+				cond = acc > in.K
+			} else if in.Code == bpfJgeK {
+				cond = acc >= in.K
+			}
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case bpfRetK:
+			return in.K
+		default:
+			t.Fatalf("unknown instruction %#x at %d", in.Code, pc)
+		}
+	}
+	t.Fatalf("filter of %d instructions does not return", len(filter))
+	return 0
+}
+
+func TestCompileDefaultProfile(t *testing.T) {
+	eperm := uint32(retErrno | errnoEPERM)
+	enosys := uint32(retErrno | errnoENOSYS)
+	cases := []struct {
+		name   string
+		caps   map[uint]bool
+		arch   uint32
+		nr     int
+		args   []uint64
+		expect uint32
+	}{
+		{"read", nil, auditArchX86_64, syscallsX86_64["read"], nil, retAllow},
+		{"mount", nil, auditArchX86_64, syscallsX86_64["mount"], nil, eperm},
+		{"mount with CAP_SYS_ADMIN", map[uint]bool{21: true}, auditArchX86_64, syscallsX86_64["mount"], nil, retAllow},
+		{"clone of a thread", nil, auditArchX86_64, syscallsX86_64["clone"], []uint64{0x00000100 | 0x00010000}, retAllow}, // CLONE_VM | CLONE_THREAD
+		{"clone of a namespace", nil, auditArchX86_64, syscallsX86_64["clone"], []uint64{cloneNewNS}, eperm},
+		{"clone3", nil, auditArchX86_64, syscallsX86_64["clone3"], nil, enosys},
+		{"clone3 with CAP_SYS_ADMIN", map[uint]bool{21: true}, auditArchX86_64, syscallsX86_64["clone3"], nil, retAllow},
+		{"personality", nil, auditArchX86_64, syscallsX86_64["personality"], []uint64{0x20008}, retAllow},
+		{"personality of another domain", nil, auditArchX86_64, syscallsX86_64["personality"], []uint64{0x1}, eperm},
+		{"socket", nil, auditArchX86_64, syscallsX86_64["socket"], []uint64{syscall.AF_INET}, retAllow},
+		{"socket of vsock", nil, auditArchX86_64, syscallsX86_64["socket"], []uint64{40}, eperm},
+		{"x32", nil, auditArchX86_64, x32SyscallBit | syscallsX86_64["read"], nil, retKillThread},
+		{"read of i386", nil, auditArchI386, syscallsX86["read"], nil, retAllow},
+		{"mount of i386", nil, auditArchI386, syscallsX86["mount"], nil, eperm},
+		{"unknown architecture", nil, 0xc00000b7, 0, nil, retKillThread},
+	}
+	for _, c := range cases {
+		filter, err := compile(DefaultProfile(), "amd64", c.caps, [2]int{5, 10})
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if got := run(t, filter, c.arch, c.nr, c.args...); got != c.expect {
+			t.Errorf("%s: expected %#x, got %#x", c.name, c.expect, got)
+		}
+	}
+	for goarch := range nativeArches {
+		if _, err := compile(DefaultProfile(), goarch, map[uint]bool{21: true}, [2]int{5, 10}); err != nil {
+			t.Errorf("%s: should not be error: %v", goarch, err)
+		}
+	}
+}
+
+func TestCompileMinKernel(t *testing.T) {
+	ptrace := syscallsX86_64["ptrace"]
+	filter, err := compile(DefaultProfile(), "amd64", nil, [2]int{4, 4})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if got := run(t, filter, auditArchX86_64, ptrace); got != retErrno|uint32(errnoEPERM) {
+		t.Errorf("ptrace should be denied before 4.8, got %#x", got)
+	}
+	filter, err = compile(DefaultProfile(), "amd64", nil, [2]int{4, 14})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if got := run(t, filter, auditArchX86_64, ptrace); got != retAllow {
+		t.Errorf("ptrace should be allowed since 4.8, got %#x", got)
+	}
+}
+
+func TestCompileArgs(t *testing.T) {
+	profile := func(args ...Arg) *Profile {
+		return &Profile{
+			DefaultAction: ActAllow,
+			Syscalls:      []Syscall{{Names: []string{"write"}, Action: ActKillProcess, Args: args}},
+		}
+	}
+	write := syscallsX86_64["write"]
+	const big = 0x100000002
+	cases := []struct {
+		args   []Arg
+		arg    uint64
+		expect uint32
+	}{
+		{[]Arg{{Index: 1, Value: big, Op: OpEqualTo}}, big, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpEqualTo}}, 2, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpNotEqual}}, 2, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpNotEqual}}, big, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterThan}}, big + 1, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterThan}}, big, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterThan}}, 3, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterEqual}}, big, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterEqual}}, 1 << 40, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpGreaterEqual}}, big - 1, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpLessThan}}, 3, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpLessThan}}, big, retAllow},
+		{[]Arg{{Index: 1, Value: big, Op: OpLessEqual}}, big, retKillProcess},
+		{[]Arg{{Index: 1, Value: big, Op: OpLessEqual}}, 1 << 33, retAllow},
+		{[]Arg{{Index: 1, Value: 0xff00000000ff, ValueTwo: 0x120000000034, Op: OpMaskedEqual}}, 0x125600007834, retKillProcess},
+		{[]Arg{{Index: 1, Value: 0xff00000000ff, ValueTwo: 0x120000000034, Op: OpMaskedEqual}}, 0x125600007835, retAllow},
+		// Conditions on different arguments must all hold.
+		{[]Arg{{Index: 0, Value: 1, Op: OpEqualTo}, {Index: 1, Value: 2, Op: OpEqualTo}}, 2, retKillProcess},
+		{[]Arg{{Index: 0, Value: 2, Op: OpEqualTo}, {Index: 1, Value: 2, Op: OpEqualTo}}, 2, retAllow},
+		// Any of the conditions on the same argument may hold.
+		{[]Arg{{Index: 1, Value: 2, Op: OpEqualTo}, {Index: 1, Value: 3, Op: OpEqualTo}}, 3, retKillProcess},
+		{[]Arg{{Index: 1, Value: 2, Op: OpEqualTo}, {Index: 1, Value: 3, Op: OpEqualTo}}, 4, retAllow},
+	}
+	for _, c := range cases {
+		filter, err := compile(profile(c.args...), "amd64", nil, [2]int{5, 10})
+		if err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+		if got := run(t, filter, auditArchX86_64, write, 1, c.arg); got != c.expect {
+			t.Errorf("%+v with %#x: expected %#x, got %#x", c.args, c.arg, c.expect, got)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	p, err := Parse([]byte(`{
+		"defaultAction": "SCMP_ACT_ERRNO",
+		"defaultErrnoRet": 38,
+		"architectures": ["SCMP_ARCH_X86_64"],
+		"syscalls": [
+			{"name": "getpid", "action": "SCMP_ACT_ALLOW"},
+			{"names": ["kill"], "action": "SCMP_ACT_TRACE", "errnoRet": 7}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	filter, err := compile(p, "amd64", nil, [2]int{5, 10})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	for nr, expect := range map[int]uint32{
+		syscallsX86_64["getpid"]: retAllow,
+		syscallsX86_64["kill"]:   retTrace | 7,
+		syscallsX86_64["read"]:   retErrno | uint32(errnoENOSYS),
+	} {
+		if got := run(t, filter, auditArchX86_64, nr); got != expect {
+			t.Errorf("syscall %d: expected %#x, got %#x", nr, expect, got)
+		}
+	}
+	// Without SCMP_ARCH_X86, i386 syscalls are not allowed.
+	if got := run(t, filter, auditArchI386, syscallsX86["getpid"]); got != retKillThread {
+		t.Errorf("i386 syscall: expected %#x, got %#x", retKillThread, got)
+	}
+
+	if _, err := Parse([]byte(`{"syscalls": []}`)); err == nil {
+		t.Error("profile without defaultAction should be error")
+	}
+	if _, err := compile(&Profile{DefaultAction: "SCMP_ACT_NOTIFY"}, "amd64", nil, [2]int{5, 10}); err == nil {
+		t.Error("unsupported action should be error")
+	}
+}
@@ -0,0 +1,106 @@
+package seccomp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Action is what the kernel does when a syscall matches a rule.
+type Action string
+
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+	ActLog         Action = "SCMP_ACT_LOG"
+)
+
+// Operator compares an argument of a syscall with the value of a rule.
+type Operator string
+
+const (
+	OpNotEqual     Operator = "SCMP_CMP_NE"
+	OpLessThan     Operator = "SCMP_CMP_LT"
+	OpLessEqual    Operator = "SCMP_CMP_LE"
+	OpEqualTo      Operator = "SCMP_CMP_EQ"
+	OpGreaterEqual Operator = "SCMP_CMP_GE"
+	OpGreaterThan  Operator = "SCMP_CMP_GT"
+	OpMaskedEqual  Operator = "SCMP_CMP_MASKED_EQ"
+)
+
+// Profile is a seccomp profile in the format of Docker, which is also the one
+// of the seccomp section of the OCI runtime spec.
+type Profile struct {
+	DefaultAction   Action    `json:"defaultAction"`
+	DefaultErrnoRet *uint     `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string  `json:"architectures,omitempty"`
+	ArchMap         []ArchMap `json:"archMap,omitempty"`
+	Syscalls        []Syscall `json:"syscalls,omitempty"`
+}
+
+// ArchMap lists the architectures whose syscalls a native architecture also runs, e.g. x86 on x86_64.
+type ArchMap struct {
+	Arch      string   `json:"architecture"`
+	SubArches []string `json:"subArchitectures"`
+}
+
+// Syscall is a rule for syscalls. All the conditions of Args must hold for the rule to match,
+// unless some of them are on the same argument: any of the conditions must hold then, as in runc.
+type Syscall struct {
+	Name     string   `json:"name,omitempty"` // older profiles name a single syscall
+	Names    []string `json:"names,omitempty"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []Arg    `json:"args,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+	Includes Filter   `json:"includes,omitempty"`
+	Excludes Filter   `json:"excludes,omitempty"`
+}
+
+// Filter selects the containers a rule applies to, by their capabilities,
+// the architecture of droot and the version of the kernel.
+type Filter struct {
+	Caps      []string `json:"caps,omitempty"`
+	Arches    []string `json:"arches,omitempty"`
+	MinKernel string   `json:"minKernel,omitempty"`
+}
+
+// Arg is a condition on the argument at Index of a syscall.
+// ValueTwo is only used by SCMP_CMP_MASKED_EQ, which compares the argument masked with Value to it.
+type Arg struct {
+	Index    uint     `json:"index"`
+	Value    uint64   `json:"value"`
+	ValueTwo uint64   `json:"valueTwo,omitempty"`
+	Op       Operator `json:"op"`
+}
+
+// Parse parses a seccomp profile.
+func Parse(b []byte) (*Profile, error) {
+	var p Profile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse seccomp profile")
+	}
+	if p.DefaultAction == "" {
+		return nil, errors.New("Seccomp profile has no defaultAction")
+	}
+	return &p, nil
+}
+
+// Load reads the seccomp profile at path.
+func Load(path string) (*Profile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read seccomp profile %s", path)
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to load %s", path)
+	}
+	return p, nil
+}
@@ -0,0 +1,42 @@
+package seccomp
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const seccompModeFilter = 2 // SECCOMP_MODE_FILTER
+
+// Install installs the filter on the calling thread, which passes it on to the programs it executes.
+// It requires either CAP_SYS_ADMIN or no_new_privs set on the thread.
+func Install(filter []Instruction) error {
+	if len(filter) == 0 {
+		return errors.New("Empty seccomp filter")
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&filter[0])),
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, seccompModeFilter, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return errors.Wrapf(err, "Failed to install seccomp filter")
+	}
+	return nil
+}
+
+func kernelVersion() ([2]int, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return [2]int{}, err
+	}
+	// Release is an array of int8 or uint8, depending on the architecture.
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	return parseKernelVersion(string(release))
+}
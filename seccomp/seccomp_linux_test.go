@@ -0,0 +1,44 @@
+package seccomp
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+// TestInstallProcess installs the default profile in a child process of TestInstall.
+func TestInstallProcess(t *testing.T) {
+	if os.Getenv("DROOT_TEST_SECCOMP") != "1" {
+		t.Skip("run by TestInstall")
+	}
+	runtime.LockOSThread()
+	filter, err := Compile(DefaultProfile(), nil)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := Install(filter); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := syscall.Sethostname([]byte("droot")); err != syscall.EPERM {
+		t.Fatalf("sethostname should fail with EPERM: %v", err)
+	}
+	if _, err := syscall.Getcwd(make([]byte, 256)); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("installing a filter without no_new_privs requires root")
+	}
+	if _, err := kernelVersion(); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInstallProcess$")
+	cmd.Env = append(os.Environ(), "DROOT_TEST_SECCOMP=1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("should not be error: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,16 @@
+// +build !linux
+
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func Install(filter []Instruction) error {
+	return fmt.Errorf("seccomp: Install not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func kernelVersion() ([2]int, error) {
+	return [2]int{}, fmt.Errorf("seccomp: kernelVersion not implemented on %s/%s", runtime.GOOS, runtime.GOARCH)
+}
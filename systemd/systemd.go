@@ -3,8 +3,8 @@ package systemd
 import (
 	"bytes"
 	"fmt"
+	"github.com/asmyasnikov/droot/manifest"
 	"github.com/asmyasnikov/droot/osutil"
-	"github.com/docker/docker/api/types"
 	"github.com/pkg/errors"
 	"os"
 	"strings"
@@ -21,18 +21,41 @@ StartLimitInterval=5
 StartLimitBurst=10
 {{if .CPUQuota}}CPUQuota={{.CPUQuota}}%{{end}}
 {{if .MemoryLimit}}MemoryLimit={{.MemoryLimit}}M{{end}}
-{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory}}/{{end}}
 ExecStart={{.ExecStart}}
 ExecStopPost={{.ExecStopPost}}
 {{if .UserName}}User={{.UserName}}{{end}}
 {{if .ReloadSignal}}ExecReload=/bin/kill -{{.ReloadSignal}} "$MAINPID"{{end}}
 {{if .Restart}}Restart={{.Restart}}{{end}}
+{{if .KillSignal}}KillSignal={{.KillSignal}}{{end}}
+{{if .TimeoutStopSec}}TimeoutStopSec={{.TimeoutStopSec}}{{end}}
+{{- range $i, $limit := .Limits}}
+{{$limit}}{{end}}
 
 [Install]
 WantedBy=multi-user.target
 `
 
-func config(root string, info *types.ContainerJSON) ([]byte, error) {
+// limits maps the names of ulimits to the directives of systemd.exec(5).
+var limits = map[string]string{
+	"as":         "LimitAS",
+	"core":       "LimitCORE",
+	"cpu":        "LimitCPU",
+	"data":       "LimitDATA",
+	"fsize":      "LimitFSIZE",
+	"locks":      "LimitLOCKS",
+	"memlock":    "LimitMEMLOCK",
+	"msgqueue":   "LimitMSGQUEUE",
+	"nice":       "LimitNICE",
+	"nofile":     "LimitNOFILE",
+	"nproc":      "LimitNPROC",
+	"rss":        "LimitRSS",
+	"rtprio":     "LimitRTPRIO",
+	"rttime":     "LimitRTTIME",
+	"sigpending": "LimitSIGPENDING",
+	"stack":      "LimitSTACK",
+}
+
+func config(root string, m *manifest.Manifest) ([]byte, error) {
 	ex, err := os.Executable()
 	if err != nil {
 		return nil, err
@@ -50,60 +73,69 @@ func config(root string, info *types.ContainerJSON) ([]byte, error) {
 		Dependencies     []string
 		ExecStart        string
 		ExecStopPost     string
-		WorkingDirectory *string
 		UserName         *string
 		ReloadSignal     int
 		Restart          string
 		CPUQuota         *int
 		MemoryLimit      *int
+		KillSignal       string
+		TimeoutStopSec   *int
+		Limits           []string
 	}{
-		info.Config.Image,
+		m.Image,
 		[]string{
 			"After=network.target",
 		},
 		ex + " run --cp --user " + func() string {
-			if len(info.Config.User) > 0 {
-				return info.Config.User
+			if len(m.User) > 0 {
+				return m.User
 			}
 			return "root"
-		}() + " --root " + root + " -- \"" + strings.Join(append(info.Config.Entrypoint, info.Config.Cmd...), "\" \"") + "\"",
+		}() + " --root " + root,
 		ex + " umount --root " + root,
 		func() *string {
-			if len(info.Config.WorkingDir) > 0 {
-				return &info.Config.WorkingDir
-			}
-			return nil
-		}(),
-		func() *string {
-			if len(info.Config.User) > 0 {
-				return &info.Config.User
+			if len(m.User) > 0 {
+				return &m.User
 			}
 			return nil
 		}(),
 		9,
 		func() string {
-			if info.HostConfig.RestartPolicy.IsAlways() {
-				return "always"
+			if m.RestartPolicy == nil {
+				return "no"
 			}
-			if info.HostConfig.RestartPolicy.IsOnFailure() {
+			switch m.RestartPolicy.Name {
+			case "always", "unless-stopped":
+				return "always"
+			case "on-failure":
 				return "on-failure"
 			}
 			return "no"
 		}(),
 		func() *int {
-			if info.HostConfig.NanoCPUs > 0 {
-				percentage := int(float32(info.HostConfig.NanoCPUs) / 10000000.0)
+			if m.NanoCPUs > 0 {
+				percentage := int(float32(m.NanoCPUs) / 10000000.0)
 				return &percentage
 			}
 			return nil
 		}(),
 		func() *int {
-			if info.HostConfig.Memory > 0 {
-				memory := int(info.HostConfig.Memory / 1024 / 1024)
+			if m.Memory > 0 {
+				memory := int(m.Memory / 1024 / 1024)
 				return &memory
 			}
 			return nil
 		}(),
+		m.StopSignal,
+		m.StopTimeout,
+		func() (directives []string) {
+			for _, l := range m.Ulimits {
+				if directive, ok := limits[l.Name]; ok {
+					directives = append(directives, fmt.Sprintf("%s=%d:%d", directive, l.Soft, l.Hard))
+				}
+			}
+			return directives
+		}(),
 	})
 	if err != nil {
 		return nil, err
@@ -111,12 +143,12 @@ func config(root string, info *types.ContainerJSON) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
-func Install(path, name string, info *types.ContainerJSON) error {
+func Install(path, name string, m *manifest.Manifest) error {
 	configPath := "/lib/systemd/system/" + name + ".service"
 	if osutil.ExistsFile(configPath) {
-		return fmt.Errorf("Systemd service config %s already exists", config)
+		return fmt.Errorf("Systemd service config %s already exists", configPath)
 	}
-	b, err := config(path, info);
+	b, err := config(path, m);
 	if err != nil {
 		return errors.Wrapf(err, "Failed to compile systemd config")
 	}
@@ -0,0 +1,299 @@
+package volume
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/docker/pkg/symlink"
+	"github.com/pkg/errors"
+
+	"github.com/asmyasnikov/droot/log"
+	"github.com/asmyasnikov/droot/osutil"
+)
+
+// DefaultRoot is the directory of the volume store of droot.
+const DefaultRoot = "/var/lib/droot/volumes"
+
+// A volume is a directory of the store named after it, holding its data in dataDir as in Docker,
+// its metadata in metadataFile and copiedFile once the files of a container were copied into it.
+const (
+	dataDir      = "_data"
+	metadataFile = "volume.json"
+	copiedFile   = ".copied"
+)
+
+// validName is the pattern of volume names, the one of Docker.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// Volume is a directory of the store, which outlives the runs of the containers it is mounted in.
+type Volume struct {
+	Name       string            `json:"name"`
+	Mountpoint string            `json:"mountpoint"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Anonymous  bool              `json:"anonymous,omitempty"` // created for a container by --volume DEST-PATH
+}
+
+// Store is the volume store in a directory, DefaultRoot unless told otherwise.
+type Store struct {
+	root string
+}
+
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+// Create creates a volume. A random name is given to a volume without one.
+// The volume is returned as it is if it exists already, as Docker does.
+func (s *Store) Create(name string, labels map[string]string) (*Volume, error) {
+	if name == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, errors.Wrapf(err, "Failed to generate volume name")
+		}
+		name = hex.EncodeToString(b)
+	}
+	return s.create(name, labels, false)
+}
+
+// CreateAnonymous creates the anonymous volume of the container in rootDir mounted on containerDir,
+// unless it exists already. It is named after them, so that every run of the container finds it.
+func (s *Store) CreateAnonymous(rootDir, containerDir string) (*Volume, error) {
+	sum := sha256.Sum256([]byte(rootDir + "\x00" + containerDir))
+	return s.create(hex.EncodeToString(sum[:]), nil, true)
+}
+
+func (s *Store) create(name string, labels map[string]string, anonymous bool) (*Volume, error) {
+	if v, err := s.Get(name); err == nil {
+		return v, nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	v := &Volume{
+		Name:       name,
+		Mountpoint: fp.Join(s.root, name, dataDir),
+		CreatedAt:  time.Now().UTC().Truncate(time.Second),
+		Labels:     labels,
+		Anonymous:  anonymous,
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(v.Mountpoint, 0755); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create volume %s", name)
+	}
+	// The metadata is written last, so that a volume is only listed once it is complete.
+	if err := ioutil.WriteFile(fp.Join(s.root, name, metadataFile), append(b, '\n'), 0644); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create volume %s", name)
+	}
+	log.Debug("create volume", name)
+	return v, nil
+}
+
+// Get returns the volume name. The error is os.ErrNotExist, once unwrapped, if there is no such volume.
+func (s *Store) Get(name string) (*Volume, error) {
+	if !validName.MatchString(name) {
+		return nil, errors.Errorf("Invalid volume name %s, which should match %s", name, validName)
+	}
+	b, err := ioutil.ReadFile(fp.Join(s.root, name, metadataFile))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(os.ErrNotExist, "No such volume %s", name)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read volume %s", name)
+	}
+	var v Volume
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse volume %s", name)
+	}
+	return &v, nil
+}
+
+// List returns the volumes of the store, sorted by name.
+func (s *Store) List() ([]*Volume, error) {
+	fis, err := ioutil.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read volume store %s", s.root)
+	}
+	var volumes []*Volume
+	for _, fi := range fis {
+		if !fi.IsDir() || !osutil.ExistsFile(fp.Join(s.root, fi.Name(), metadataFile)) {
+			continue
+		}
+		v, err := s.Get(fi.Name())
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+// Remove removes the volume name and its data. A volume mounted in the mount namespace of droot
+// is refused unless force is set.
+func (s *Store) Remove(name string, force bool) error {
+	v, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+	if !force {
+		mountpoints, err := mountpointsOf(v.Mountpoint)
+		if err != nil {
+			return err
+		}
+		if len(mountpoints) > 0 {
+			return errors.Errorf("Volume %s is in use at %s", name, strings.Join(mountpoints, ", "))
+		}
+	}
+	// The metadata is removed first, so that a volume partly removed is not listed.
+	if err := os.Remove(fp.Join(s.root, name, metadataFile)); err != nil {
+		return errors.Wrapf(err, "Failed to remove volume %s", name)
+	}
+	if err := os.RemoveAll(fp.Join(s.root, name)); err != nil {
+		return errors.Wrapf(err, "Failed to remove volume %s", name)
+	}
+	log.Debug("remove volume", name)
+	return nil
+}
+
+// mountpointsOf returns the mount points dir is bind mounted on, which are the ones of the same device as dir
+// whose root is dir.
+func mountpointsOf(dir string) ([]string, error) {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+	var mountpoints []string
+	for _, mo := range mounts {
+		if int64(mo.Major) != osutil.Major(uint64(st.Dev)) || int64(mo.Minor) != osutil.Minor(uint64(st.Dev)) {
+			continue
+		}
+		if mfi, err := os.Stat(mo.Mountpoint); err == nil && os.SameFile(fi, mfi) {
+			mountpoints = append(mountpoints, mo.Mountpoint)
+		}
+	}
+	return mountpoints, nil
+}
+
+// ParseVolumeOption parses [NAME:]DEST-PATH[:OPTIONS] of --volume. A volume without a name is anonymous.
+// The options are the ones of --bind, and nocopy, which keeps the files of the container at DEST-PATH out
+// of a new volume.
+func ParseVolumeOption(volumeOption string) (name, containerDir string, options []string, err error) {
+	d := strings.SplitN(volumeOption, ":", 3)
+	switch {
+	case len(d) == 1:
+		containerDir = d[0]
+	case fp.IsAbs(d[0]):
+		containerDir, options = d[0], strings.Split(strings.Join(d[1:], ":"), ",")
+	default:
+		name, containerDir = d[0], d[1]
+		if len(d) == 3 {
+			options = strings.Split(d[2], ",")
+		}
+	}
+	if name != "" && !validName.MatchString(name) {
+		return name, containerDir, options, errors.Errorf("Invalid volume name %s, which should match %s", name, validName)
+	}
+	if !fp.IsAbs(containerDir) {
+		return name, containerDir, options, errors.Errorf("%s is not an absolute path", containerDir)
+	}
+	return name, fp.Clean(containerDir), options, nil
+}
+
+// Binds creates the volumes of volumeOpts of the container in rootDir which do not exist yet, and returns
+// the bind options of --bind mounting them. The container runs in runDir, rootDir itself or an overlay of it.
+// Like Docker, the files of the container at the destination of a new volume are copied into it, unless the
+// volume has the option nocopy.
+func (s *Store) Binds(rootDir, runDir string, volumeOpts []string) ([]string, error) {
+	var binds []string
+	for _, volumeOption := range volumeOpts {
+		name, containerDir, options, err := ParseVolumeOption(volumeOption)
+		if err != nil {
+			return nil, err
+		}
+		var bindOpts []string
+		copyUp := true
+		for _, opt := range options {
+			if opt == "nocopy" {
+				copyUp = false
+			} else if opt != "" {
+				bindOpts = append(bindOpts, opt)
+			}
+		}
+
+		var v *Volume
+		if name == "" {
+			v, err = s.CreateAnonymous(rootDir, containerDir)
+		} else {
+			v, err = s.Create(name, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The destination is resolved in the container, so that a symlink of the image, such as
+		// /data -> /etc, can not make droot copy files of the host or mount the volume over them.
+		dest, err := symlink.FollowSymlinkInScope(fp.Join(runDir, containerDir), runDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to resolve %s in the container", containerDir)
+		}
+		if copyUp {
+			if err := copyUpOnce(v, dest); err != nil {
+				return nil, errors.Wrapf(err, "Failed to copy %s into volume %s", containerDir, v.Name)
+			}
+		}
+		rel, err := fp.Rel(runDir, dest)
+		if err != nil {
+			return nil, err
+		}
+
+		bind := v.Mountpoint + ":" + fp.Join("/", rel)
+		if len(bindOpts) > 0 {
+			bind += ":" + strings.Join(bindOpts, ",")
+		}
+		binds = append(binds, bind)
+	}
+	return binds, nil
+}
+
+// copyUpOnce copies the files of src into the volume v, only the first time it is mounted and while it is
+// empty, so that the files written to the volume later are never overwritten nor mixed with others.
+// src must be resolved in the container already, and nothing is copied unless it is a directory.
+func copyUpOnce(v *Volume, src string) error {
+	done := fp.Join(fp.Dir(v.Mountpoint), copiedFile)
+	if osutil.ExistsFile(done) {
+		return nil
+	}
+	if !osutil.IsDirEmpty(v.Mountpoint) {
+		return nil
+	}
+	if fi, err := os.Lstat(src); err == nil && fi.IsDir() && !osutil.IsDirEmpty(src) {
+		if err := osutil.RunCmd("cp", "-a", src+"/.", v.Mountpoint); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(done, nil, 0644)
+}
@@ -0,0 +1,273 @@
+package volume
+
+import (
+	"io/ioutil"
+	"os"
+	fp "path/filepath"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/pkg/errors"
+)
+
+func TestParseVolumeOption(t *testing.T) {
+	cases := []struct {
+		opt          string
+		name         string
+		containerDir string
+		options      []string
+		hasErr       bool
+	}{
+		{"/data", "", "/data", nil, false},
+		{"/data/", "", "/data", nil, false},
+		{"/data:ro", "", "/data", []string{"ro"}, false},
+		{"/data:ro,nocopy", "", "/data", []string{"ro", "nocopy"}, false},
+		{"data:/data", "data", "/data", nil, false},
+		{"data:/data:ro,noexec", "data", "/data", []string{"ro", "noexec"}, false},
+		{"data", "", "", nil, true},
+		{"data:data", "", "", nil, true},
+		{"-data:/data", "", "", nil, true},
+		{"d:/data", "", "", nil, true},
+	}
+	for _, c := range cases {
+		name, containerDir, options, err := ParseVolumeOption(c.opt)
+		if c.hasErr {
+			if err == nil {
+				t.Errorf("%s should be error", c.opt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s should not be error: %v", c.opt, err)
+			continue
+		}
+		if diff := pretty.Compare([]interface{}{name, containerDir, options}, []interface{}{c.name, c.containerDir, c.options}); diff != "" {
+			t.Errorf("%s diff: (-actual +expected)\n%s", c.opt, diff)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "droot-volumes")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	s := NewStore(root)
+
+	if volumes, err := s.List(); err != nil || len(volumes) != 0 {
+		t.Fatalf("should be empty: %v, %v", volumes, err)
+	}
+
+	v, err := s.Create("data", map[string]string{"app": "web"})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if v.Mountpoint != fp.Join(root, "data", "_data") {
+		t.Errorf("unexpected mountpoint %s", v.Mountpoint)
+	}
+	if err := ioutil.WriteFile(fp.Join(v.Mountpoint, "file"), []byte("data"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// A volume is created only once, and keeps its data.
+	again, err := s.Create("data", nil)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if diff := pretty.Compare(again, v); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+	random, err := s.Create("", nil)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	anonymous, err := s.CreateAnonymous("/var/containers/app", "/data")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if !anonymous.Anonymous {
+		t.Error("should be anonymous")
+	}
+	if again, err := s.CreateAnonymous("/var/containers/app", "/data"); err != nil || again.Name != anonymous.Name {
+		t.Errorf("should be the same volume %s: %v, %v", anonymous.Name, again, err)
+	}
+	if other, err := s.CreateAnonymous("/var/containers/other", "/data"); err != nil || other.Name == anonymous.Name {
+		t.Errorf("should be another volume than %s: %v, %v", anonymous.Name, other, err)
+	}
+
+	volumes, err := s.List()
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	var names []string
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	if len(names) != 4 || names[0] > names[1] || names[1] > names[2] || names[2] > names[3] {
+		t.Errorf("should be 4 volumes sorted by name: %v", names)
+	}
+
+	if _, err := s.Create("invalid/name", nil); err == nil {
+		t.Error("should be error")
+	}
+	if err := s.Remove("data", false); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if _, err := s.Get("data"); !os.IsNotExist(errors.Cause(err)) {
+		t.Errorf("should not exist: %v", err)
+	}
+	if err := s.Remove("data", false); err == nil {
+		t.Error("should be error")
+	}
+	if err := s.Remove(random.Name, false); err != nil {
+		t.Errorf("should not be error: %v", err)
+	}
+}
+
+func TestRemoveMounted(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	root, err := ioutil.TempDir("", "droot-volumes")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	s := NewStore(root)
+	v, err := s.Create("data", nil)
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+
+	target := fp.Join(root, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := mount.Mount(v.Mountpoint, target, "none", "bind"); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer mount.Unmount(target)
+
+	if err := s.Remove("data", false); err == nil {
+		t.Error("should be error, since it is mounted")
+	}
+	if err := mount.Unmount(target); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := s.Remove("data", false); err != nil {
+		t.Errorf("should not be error: %v", err)
+	}
+}
+
+func TestBinds(t *testing.T) {
+	root, err := ioutil.TempDir("", "droot-volumes")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	rootDir := fp.Join(root, "container")
+	if err := os.MkdirAll(fp.Join(rootDir, "data"), 0755); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := ioutil.WriteFile(fp.Join(rootDir, "data", "file"), []byte("image"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	s := NewStore(fp.Join(root, "volumes"))
+
+	binds, err := s.Binds(rootDir, rootDir, []string{"data:/data:ro", "empty:/data:nocopy", "/data"})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	anonymous, err := s.CreateAnonymous(rootDir, "/data")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected := []string{
+		fp.Join(root, "volumes", "data", "_data") + ":/data:ro",
+		fp.Join(root, "volumes", "empty", "_data") + ":/data",
+		anonymous.Mountpoint + ":/data",
+	}
+	if diff := pretty.Compare(binds, expected); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+
+	// The files of the container are copied into new volumes only.
+	read := func(volume string) string {
+		b, _ := ioutil.ReadFile(fp.Join(root, "volumes", volume, "_data", "file"))
+		return string(b)
+	}
+	if got := read("data"); got != "image" {
+		t.Errorf("expected image, got %q", got)
+	}
+	if got := read("empty"); got != "" {
+		t.Errorf("expected nothing, got %q", got)
+	}
+	if err := ioutil.WriteFile(fp.Join(root, "volumes", "data", "_data", "file"), []byte("volume"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Remove(fp.Join(root, "volumes", anonymous.Name, "_data", "file")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if _, err := s.Binds(rootDir, rootDir, []string{"data:/data", "/data"}); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if got := read("data"); got != "volume" {
+		t.Errorf("expected volume, got %q", got)
+	}
+	if got := read(anonymous.Name); got != "" {
+		t.Errorf("expected nothing, got %q", got)
+	}
+}
+
+func TestBindsSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "droot-volumes")
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	defer os.RemoveAll(root)
+	rootDir, host := fp.Join(root, "container"), fp.Join(root, "host")
+	for _, dir := range []string{fp.Join(rootDir, "etc"), host} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("should not be error: %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(fp.Join(host, "shadow"), []byte("host"), 0600); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := ioutil.WriteFile(fp.Join(rootDir, "etc", "hostname"), []byte("container"), 0644); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	// Symlinks of the image pointing out of the container, absolute or relative.
+	if err := os.Symlink(host, fp.Join(rootDir, "abs")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Symlink("../../host", fp.Join(rootDir, "rel")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	if err := os.Symlink("/etc", fp.Join(rootDir, "data")); err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	s := NewStore(fp.Join(root, "volumes"))
+
+	binds, err := s.Binds(rootDir, rootDir, []string{"abs:/abs", "rel:/rel", "data:/data"})
+	if err != nil {
+		t.Fatalf("should not be error: %v", err)
+	}
+	expected := []string{
+		fp.Join(root, "volumes", "abs", "_data") + ":" + host,
+		fp.Join(root, "volumes", "rel", "_data") + ":/host",
+		fp.Join(root, "volumes", "data", "_data") + ":/etc",
+	}
+	if diff := pretty.Compare(binds, expected); diff != "" {
+		t.Errorf("diff: (-actual +expected)\n%s", diff)
+	}
+	for _, name := range []string{"abs", "rel"} {
+		if fis, _ := ioutil.ReadDir(fp.Join(root, "volumes", name, "_data")); len(fis) != 0 {
+			t.Errorf("nothing of the host should be copied into %s: %d files", name, len(fis))
+		}
+	}
+	if b, _ := ioutil.ReadFile(fp.Join(root, "volumes", "data", "_data", "hostname")); string(b) != "container" {
+		t.Errorf("/etc of the container should be copied: got %q", b)
+	}
+}